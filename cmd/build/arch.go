@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultArch is used when neither -arch nor TAILPOD_ARCH is set.
+const defaultArch = "arm64"
+
+// archAliases maps uname-style machine names to the Go/release naming used
+// in GitHub release asset names. An architecture is listed only once every
+// entry in releaseBinaries has a hash for it; amd64 (and its x86_64 alias)
+// returns when the amd64 release digests are recorded.
+var archAliases = map[string]string{
+	"arm64":   "arm64",
+	"aarch64": "arm64",
+}
+
+// releaseBinary is a binary fetched from GitHub Releases at first boot.
+// The .bu files reference it through ${<prefix>_URL} and ${<prefix>_HASH}.
+type releaseBinary struct {
+	prefix  string
+	repo    string // github.com/engie/<repo>, also the asset name stem
+	version string
+	sha256  map[string]string // arch -> hex digest of <repo>-linux-<arch>
+}
+
+// releaseBinaries is the per-arch table of downloaded binaries. Adding an
+// architecture means recording the sha256 of each release asset here.
+var releaseBinaries = []releaseBinary{
+	{
+		prefix:  "QUADSYNC",
+		repo:    "quadsync",
+		version: "v0.8",
+		sha256: map[string]string{
+			"arm64": "bb5c61dc6ba2e59c2d663436db3e17e4a6646e0864b7794f5adb02fcab34e91c",
+		},
+	},
+	{
+		prefix:  "NETAVARK_TAILSCALE_PLUGIN",
+		repo:    "netavark-tailscale-plugin",
+		version: "v0.4",
+		sha256: map[string]string{
+			"arm64": "86b714f3ecdb3ac2569a6d858cfec2d03d862549183b61709eed309b6c6df11a",
+		},
+	},
+	{
+		prefix:  "TAILMINT",
+		repo:    "tailmint",
+		version: "v0.4",
+		sha256: map[string]string{
+			"arm64": "28ab8d22fa268028f40ee0ab29314b166e79a918b1d8ba255a5a30a4af9c6b8f",
+		},
+	},
+}
+
+// parseArchList parses a comma- or space-separated list of architectures,
+// normalizing aliases (x86_64, aarch64) and dropping duplicates.
+func parseArchList(s string) ([]string, error) {
+	var archs []string
+	seen := make(map[string]bool)
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		arch, ok := archAliases[strings.ToLower(field)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported architecture %q (want %s)", field, strings.Join(supportedArchs(), " or "))
+		}
+		if !seen[arch] {
+			seen[arch] = true
+			archs = append(archs, arch)
+		}
+	}
+	if len(archs) == 0 {
+		return nil, fmt.Errorf("empty architecture list")
+	}
+	return archs, nil
+}
+
+// supportedArchs returns the release architectures accepted by -arch and
+// TAILPOD_ARCH, sorted.
+func supportedArchs() []string {
+	seen := make(map[string]bool)
+	var archs []string
+	for _, arch := range archAliases {
+		if !seen[arch] {
+			seen[arch] = true
+			archs = append(archs, arch)
+		}
+	}
+	sort.Strings(archs)
+	return archs
+}
+
+// binaryVars returns the ${<prefix>_URL} and ${<prefix>_HASH} build-time
+// variables for every release binary on the given architecture.
+func binaryVars(arch string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, bin := range releaseBinaries {
+		sum, ok := bin.sha256[arch]
+		if !ok {
+			return nil, fmt.Errorf("no %s release hash recorded for %s %s; add it to releaseBinaries in cmd/build/arch.go", arch, bin.repo, bin.version)
+		}
+		vars[bin.prefix+"_URL"] = fmt.Sprintf("https://github.com/engie/%s/releases/download/%s/%s-linux-%s", bin.repo, bin.version, bin.repo, arch)
+		vars[bin.prefix+"_HASH"] = "sha256-" + sum
+	}
+	return vars, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseArchList(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"arm64", []string{"arm64"}},
+		{"aarch64", []string{"arm64"}},
+		{"ARM64", []string{"arm64"}},
+		{"arm64, aarch64", []string{"arm64"}},
+	}
+	for _, tt := range tests {
+		got, err := parseArchList(tt.input)
+		if err != nil {
+			t.Errorf("parseArchList(%q): unexpected error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseArchList(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseArchListRejectsUnknown(t *testing.T) {
+	// amd64 is rejected until its release hashes are recorded.
+	for _, input := range []string{"riscv64", "amd64", "x86_64", "", " , "} {
+		if _, err := parseArchList(input); err == nil {
+			t.Errorf("parseArchList(%q): expected error", input)
+		}
+	}
+}
+
+func TestBinaryVarsArm64(t *testing.T) {
+	vars, err := binaryVars("arm64")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := vars["QUADSYNC_URL"], "https://github.com/engie/quadsync/releases/download/v0.8/quadsync-linux-arm64"; got != want {
+		t.Errorf("QUADSYNC_URL = %q, want %q", got, want)
+	}
+	for _, bin := range releaseBinaries {
+		if !strings.HasPrefix(vars[bin.prefix+"_HASH"], "sha256-") {
+			t.Errorf("%s_HASH = %q, want sha256- prefix", bin.prefix, vars[bin.prefix+"_HASH"])
+		}
+		if !strings.HasSuffix(vars[bin.prefix+"_URL"], "-linux-arm64") {
+			t.Errorf("%s_URL = %q, want arm64 asset", bin.prefix, vars[bin.prefix+"_URL"])
+		}
+	}
+}
+
+func TestBinaryVarsMissingHash(t *testing.T) {
+	_, err := binaryVars("riscv64")
+	if err == nil {
+		t.Fatal("expected error for arch without recorded hashes")
+	}
+	if !strings.Contains(err.Error(), "releaseBinaries") {
+		t.Errorf("error %q should point at releaseBinaries", err)
+	}
+}
+
+func TestReleaseBinariesCoverEveryArch(t *testing.T) {
+	hexDigest := regexp.MustCompile(`^[0-9a-f]{64}$`)
+	for _, arch := range supportedArchs() {
+		var missing []string
+		for _, bin := range releaseBinaries {
+			sum, ok := bin.sha256[arch]
+			if !ok {
+				missing = append(missing, bin.repo+" "+bin.version)
+				continue
+			}
+			if !hexDigest.MatchString(sum) {
+				t.Errorf("%s %s: %s hash %q is not a hex sha256", bin.repo, bin.version, arch, sum)
+			}
+		}
+		if len(missing) > 0 {
+			t.Errorf("%s: no release hash for %s; -arch %s builds fail until it is added to releaseBinaries", arch, strings.Join(missing, ", "), arch)
+		}
+	}
+}
+
+// withAMD64 accepts amd64 for the length of the test, with placeholder
+// digests, so the two-architecture build can be tested before the real
+// amd64 release digests are recorded in releaseBinaries.
+func withAMD64(t *testing.T) {
+	t.Helper()
+	aliases, bins := archAliases, releaseBinaries
+	t.Cleanup(func() { archAliases, releaseBinaries = aliases, bins })
+
+	archAliases = map[string]string{"amd64": "amd64", "x86_64": "amd64"}
+	for k, v := range aliases {
+		archAliases[k] = v
+	}
+	releaseBinaries = nil
+	for _, bin := range bins {
+		sums := map[string]string{"amd64": strings.Repeat("0", 64)}
+		for k, v := range bin.sha256 {
+			sums[k] = v
+		}
+		bin.sha256 = sums
+		releaseBinaries = append(releaseBinaries, bin)
+	}
+}
+
+func TestBuildEveryArch(t *testing.T) {
+	withAMD64(t)
+	archs, err := parseArchList("amd64,arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arch := range archs {
+		vars, err := binaryVars(arch)
+		if err != nil {
+			t.Fatalf("%s: %v", arch, err)
+		}
+		for _, bin := range releaseBinaries {
+			if want := bin.repo + "-linux-" + arch; !strings.HasSuffix(vars[bin.prefix+"_URL"], want) {
+				t.Errorf("%s_URL = %q, want the %s asset", bin.prefix, vars[bin.prefix+"_URL"], want)
+			}
+			if got, want := vars[bin.prefix+"_HASH"], "sha256-"+bin.sha256[arch]; got != want {
+				t.Errorf("%s: %s_HASH = %q, want %q", arch, bin.prefix, got, want)
+			}
+		}
+	}
+
+	dir := withWorkspace(t, "alpha")
+	if err := buildAll("", buildOptions{build: "test", arch: "amd64,arm64"}); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	for _, name := range []string{"alpha-amd64.ign", "alpha-arm64.ign"} {
+		if _, err := os.Stat(filepath.Join(dir, outDir, name)); err != nil {
+			t.Errorf("one run should write both architectures: %v", err)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// runDiff implements `tailpod diff old.ign new.ign`.
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("tailpod diff", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: tailpod diff OLD.ign NEW.ign")
+	}
+	a, err := loadIgnition(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := loadIgnition(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	out := semanticDiff(a, b)
+	if out == "" {
+		fmt.Println("No differences.")
+		return nil
+	}
+	fmt.Print(out)
+	return nil
+}
+
+// semanticDiff compares two Ignition configs entry by entry rather than as
+// JSON text: files, directories and links by path; units, users and groups
+// by name. Inline contents are decoded and shown as a unified diff, except for
+// secret-bearing files, which are only reported as changed.
+func semanticDiff(a, b map[string]any) string {
+	var sb strings.Builder
+	diffSection(&sb, a, b, "storage", "files", "path", diffFile)
+	diffSection(&sb, a, b, "storage", "directories", "path", diffFields)
+	diffSection(&sb, a, b, "storage", "links", "path", diffFields)
+	diffSection(&sb, a, b, "systemd", "units", "name", diffUnit)
+	diffSection(&sb, a, b, "passwd", "users", "name", diffFields)
+	diffSection(&sb, a, b, "passwd", "groups", "name", diffFields)
+	return sb.String()
+}
+
+// entryDiff writes the changes between two entries with the same key,
+// one indented line per change.
+type entryDiff func(sb *strings.Builder, key string, a, b map[string]any)
+
+// diffSection writes added (+), removed (-) and changed (~) entries of one
+// section under a "section.field:" heading, or nothing if they are equal.
+func diffSection(sb *strings.Builder, a, b map[string]any, section, field, key string, diff entryDiff) {
+	aIdx, aOrder := ignIndex(a, section, field, key)
+	bIdx, bOrder := ignIndex(b, section, field, key)
+
+	var body strings.Builder
+	for _, k := range aOrder {
+		if _, ok := bIdx[k]; !ok {
+			fmt.Fprintf(&body, "  - %s%s\n", k, modeSuffix(aIdx[k]))
+		}
+	}
+	for _, k := range bOrder {
+		if _, ok := aIdx[k]; !ok {
+			fmt.Fprintf(&body, "  + %s%s\n", k, modeSuffix(bIdx[k]))
+		}
+	}
+	for _, k := range aOrder {
+		bEntry, ok := bIdx[k]
+		if !ok {
+			continue
+		}
+		var changes strings.Builder
+		diff(&changes, k, aIdx[k], bEntry)
+		if changes.Len() > 0 {
+			fmt.Fprintf(&body, "  ~ %s\n%s", k, changes.String())
+		}
+	}
+	if body.Len() > 0 {
+		fmt.Fprintf(sb, "%s.%s:\n%s", section, field, body.String())
+	}
+}
+
+func modeSuffix(entry map[string]any) string {
+	if m := formatMode(entry["mode"]); m != "" {
+		return " (" + m + ")"
+	}
+	return ""
+}
+
+// diffFields writes "key: old -> new" for every top-level field that differs.
+func diffFields(sb *strings.Builder, _ string, a, b map[string]any) {
+	diffFieldsExcept(sb, a, b)
+}
+
+// diffFieldsExcept is diffFields ignoring the fields listed in skip.
+func diffFieldsExcept(sb *strings.Builder, a, b map[string]any, skip ...string) {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	for _, k := range skip {
+		delete(keys, k)
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		av, bv := formatValue(k, a[k]), formatValue(k, b[k])
+		if av == bv {
+			continue
+		}
+		if k == "passwordHash" {
+			fmt.Fprintf(sb, "      %s: changed (redacted)\n", k)
+			continue
+		}
+		fmt.Fprintf(sb, "      %s: %s -> %s\n", k, av, bv)
+	}
+}
+
+// diffFile compares storage.files entries, decoding inline contents.
+func diffFile(sb *strings.Builder, path string, a, b map[string]any) {
+	diffFieldsExcept(sb, a, b, "contents")
+
+	aText, aErr := decodeDataURI(a)
+	bText, bErr := decodeDataURI(b)
+	if isSecretFile(a) || isSecretFile(b) {
+		// Never print a credential, decoded or not.
+		changed := aText != bText
+		if aErr != nil || bErr != nil {
+			changed = formatValue("contents", a["contents"]) != formatValue("contents", b["contents"])
+		}
+		if changed {
+			fmt.Fprintf(sb, "      contents: changed (redacted)\n")
+		}
+		return
+	}
+	if aErr != nil || bErr != nil {
+		// Remote or undecodable source: compare the source descriptions.
+		if as, bs := describeContents(a), describeContents(b); as != bs {
+			fmt.Fprintf(sb, "      contents: %s -> %s\n", as, bs)
+		}
+		return
+	}
+	if aText == bText {
+		return
+	}
+	writeIndented(sb, unifiedDiff("a"+path, "b"+path, aText, bText))
+}
+
+// describeContents summarizes contents that can't be decoded to text.
+func describeContents(entry map[string]any) string {
+	if r := remoteSource(entry); r != "" {
+		return r
+	}
+	if _, err := decodeDataURI(entry); err == nil {
+		return "inline"
+	}
+	return formatValue("contents", entry["contents"])
+}
+
+// diffUnit compares systemd units, diffing contents and drop-ins as text.
+func diffUnit(sb *strings.Builder, name string, a, b map[string]any) {
+	diffFieldsExcept(sb, a, b, "contents", "dropins")
+
+	aText, _ := a["contents"].(string)
+	bText, _ := b["contents"].(string)
+	writeIndented(sb, unifiedDiff("a/"+name, "b/"+name, aText, bText))
+
+	aDropins := make(map[string]any)
+	var aOrder []string
+	for _, item := range asSlice(a["dropins"]) {
+		if m, ok := item.(map[string]any); ok {
+			dn := fmt.Sprint(m["name"])
+			aDropins[dn] = m["contents"]
+			aOrder = append(aOrder, dn)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, item := range asSlice(b["dropins"]) {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		dn := fmt.Sprint(m["name"])
+		seen[dn] = true
+		old, existed := aDropins[dn]
+		if !existed {
+			fmt.Fprintf(sb, "      + dropin %s\n", dn)
+			continue
+		}
+		oldText, _ := old.(string)
+		newText, _ := m["contents"].(string)
+		writeIndented(sb, unifiedDiff("a/"+name+".d/"+dn, "b/"+name+".d/"+dn, oldText, newText))
+	}
+	for _, dn := range aOrder {
+		if !seen[dn] {
+			fmt.Fprintf(sb, "      - dropin %s\n", dn)
+		}
+	}
+}
+
+func asSlice(v any) []any {
+	s, _ := v.([]any)
+	return s
+}
+
+func writeIndented(sb *strings.Builder, text string) {
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line != "" {
+			sb.WriteString("      " + line)
+		}
+	}
+}
+
+// diffOp is one line of an edit script: ' ' (keep), '-' (delete) or '+' (insert).
+// a and b are the 0-based line numbers in each input before this op.
+type diffOp struct {
+	kind byte
+	text string
+	a, b int
+}
+
+// unifiedDiff returns a unified diff between two texts, or "" if equal.
+func unifiedDiff(aName, bName, a, b string) string {
+	if a == b {
+		return ""
+	}
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var changes []int
+	for i, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return "" // differ only in the trailing newline
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+	for i := 0; i < len(changes); {
+		start := max(changes[i]-diffContext, 0)
+		end := changes[i] + diffContext + 1
+		j := i
+		for j+1 < len(changes) && changes[j+1]-diffContext <= end {
+			j++
+			end = changes[j] + diffContext + 1
+		}
+		end = min(end, len(ops))
+
+		aStart, bStart := ops[start].a+1, ops[start].b+1
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.text)
+			sb.WriteByte('\n')
+		}
+		i = j + 1
+	}
+	return sb.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines computes a line edit script from the longest common subsequence.
+// Ignition files are small, so the quadratic table is fine.
+func diffLines(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', a[i], i, j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j], i, j})
+			j++
+		}
+	}
+	return ops
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// An env file (site.env or common.env) may be kept encrypted with age as
+// <name>.enc, to a passphrase or to the recipients listed in
+// <name>.recipients. It is decrypted in memory when read; the plaintext
+// never touches the disk.
+const (
+	encSuffix        = ".enc"
+	recipientsSuffix = ".recipients"
+	encryptedEnv     = "site.env" + encSuffix
+	recipientsEnv    = "site.env" + recipientsSuffix
+)
+
+const (
+	ageHeader      = "age-encryption.org/v1\n"
+	ageArmorBegin  = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageArmorEnd    = "-----END AGE ENCRYPTED FILE-----"
+	ageIdentityEnv = "TAILPOD_AGE_IDENTITY"
+)
+
+// shmDir is the memory-backed directory tried after $XDG_RUNTIME_DIR.
+var shmDir = "/dev/shm"
+
+// ageMu serializes age runs so that passphrase prompts from sites building
+// in parallel don't interleave.
+var ageMu sync.Mutex
+
+// envFile returns the site's env file: site.env, or site.env.enc if only
+// that exists.
+func (s site) envFile() (string, error) {
+	return plainOrEncrypted(filepath.Join(s.dir, "site.env"))
+}
+
+// plainOrEncrypted returns plain, or plain.enc if only that exists. Having
+// both is an error.
+func plainOrEncrypted(plain string) (string, error) {
+	enc := plain + encSuffix
+	_, plainErr := os.Stat(plain)
+	_, encErr := os.Stat(enc)
+	switch {
+	case plainErr == nil && encErr == nil:
+		return "", fmt.Errorf("both %s and %s exist; remove the plaintext one once it is encrypted", plain, enc)
+	case encErr == nil:
+		return enc, nil
+	}
+	return plain, plainErr
+}
+
+// readEnvFile reads an env file, decrypting it in memory if it is a .enc.
+func readEnvFile(path string) ([]byte, error) {
+	if strings.HasSuffix(path, encSuffix) {
+		return decryptEnv(path)
+	}
+	return os.ReadFile(path)
+}
+
+// agePassphrase reports whether the age file data is encrypted with a
+// passphrase rather than to recipients, from the stanzas in its header.
+func agePassphrase(data []byte) (bool, error) {
+	if rest, ok := bytes.CutPrefix(bytes.TrimSpace(data), []byte(ageArmorBegin)); ok {
+		body, _, _ := bytes.Cut(rest, []byte(ageArmorEnd))
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+		if err != nil {
+			return false, fmt.Errorf("bad age armor: %w", err)
+		}
+		data = decoded
+	}
+	if !bytes.HasPrefix(data, []byte(ageHeader)) {
+		return false, errors.New("not an age-encrypted file")
+	}
+	for _, line := range strings.Split(string(data[len(ageHeader):]), "\n") {
+		if strings.HasPrefix(line, "---") {
+			break
+		}
+		if strings.HasPrefix(line, "-> scrypt ") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ageIdentity returns the identity file to decrypt with: $TAILPOD_AGE_IDENTITY,
+// or ~/.ssh/id_ed25519 if it exists.
+func ageIdentity() (string, error) {
+	if id := os.Getenv(ageIdentityEnv); id != "" {
+		return id, nil
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		id := filepath.Join(home, ".ssh", "id_ed25519")
+		if _, err := os.Stat(id); err == nil {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("set %s to your age identity file or SSH private key", ageIdentityEnv)
+}
+
+// decryptEnv decrypts an age-encrypted env file with `age --decrypt` and
+// returns the plaintext. A passphrase is prompted for on the terminal.
+func decryptEnv(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := agePassphrase(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	args := []string{"--decrypt"}
+	if !passphrase {
+		id, err := ageIdentity()
+		if err != nil {
+			return nil, fmt.Errorf("%s is encrypted to recipients: %w", path, err)
+		}
+		args = append(args, "--identity", id)
+	}
+	args = append(args, path)
+
+	ageMu.Lock()
+	defer ageMu.Unlock()
+	var stderr bytes.Buffer
+	cmd := exec.Command("age", args...)
+	cmd.Stderr = &stderr
+	if passphrase {
+		// age prompts on the terminal; let its messages through.
+		fmt.Fprintf(os.Stderr, "Decrypting %s\n", path)
+		cmd.Stderr = os.Stderr
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("decrypting %s: age: %w\n%s", path, err, msg)
+		}
+		return nil, fmt.Errorf("decrypting %s: age: %w", path, err)
+	}
+	return out, nil
+}
+
+// encryptEnv encrypts plaintext with `age --encrypt` to the recipients in
+// recipientsFile, or to a passphrase prompted for if it is empty, and
+// replaces path with the result.
+func encryptEnv(path string, plaintext []byte, recipientsFile string) error {
+	tmp := path + ".tmp"
+	args := []string{"--encrypt", "--armor", "--output", tmp}
+	if recipientsFile != "" {
+		args = append(args, "--recipients-file", recipientsFile)
+	} else {
+		args = append(args, "--passphrase")
+	}
+	ageMu.Lock()
+	defer ageMu.Unlock()
+	cmd := exec.Command("age", args...)
+	cmd.Stdin = bytes.NewReader(plaintext)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("encrypting %s: age: %w", path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// recipientsFor returns the recipients file of the env file plain, or "" if
+// it has none and so uses a passphrase.
+func recipientsFor(plain string) string {
+	p := plain + recipientsSuffix
+	if _, err := os.Stat(p); err != nil {
+		return ""
+	}
+	return p
+}
+
+// editTempDir returns a directory to hold a decrypted file while it is
+// edited, and whether it is memory-backed: $XDG_RUNTIME_DIR or /dev/shm, so
+// that the plaintext never reaches the disk. Where there is neither, as on
+// macOS, it fails unless allowDisk permits the user's temporary directory.
+func editTempDir(allowDisk bool) (dir string, memory bool, err error) {
+	isDir := func(d string) bool {
+		fi, err := os.Stat(d)
+		return d != "" && err == nil && fi.IsDir()
+	}
+	for _, d := range []string{os.Getenv("XDG_RUNTIME_DIR"), shmDir} {
+		if isDir(d) {
+			return d, true, nil
+		}
+	}
+	if !allowDisk {
+		return "", false, fmt.Errorf("no memory-backed directory to edit the decrypted file in: $XDG_RUNTIME_DIR and %s don't exist; pass -allow-disk to use the temporary directory %s, which may be written to disk", shmDir, os.TempDir())
+	}
+	if d := os.TempDir(); isDir(d) {
+		return d, false, nil
+	}
+	return "", false, fmt.Errorf("temporary directory %s doesn't exist; set TMPDIR to a private directory", os.TempDir())
+}
+
+// listFlag is a repeatable string flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ", ") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runSite implements `tailpod site encrypt` and `tailpod site edit`, which
+// work on a site's site.env, or on common.env with -common.
+func runSite(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "encrypt":
+			return runSiteEncrypt(args[1:])
+		case "edit":
+			return runSiteEdit(args[1:])
+		}
+	}
+	return fmt.Errorf("usage: tailpod site encrypt|edit [-site NAME | -common]")
+}
+
+// envTarget returns the plaintext path of the env file to work on: the
+// named site's site.env (the working directory's for the single-site
+// layout), or common.env.
+func envTarget(name string, common bool) (string, error) {
+	switch {
+	case common && name != "":
+		return "", fmt.Errorf("give -site or -common, not both")
+	case common:
+		return commonEnv, nil
+	case name == "":
+		return "site.env", nil
+	}
+	dir := filepath.Join(sitesDir, name)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("site %q: no %s directory", name, dir)
+	}
+	return filepath.Join(dir, "site.env"), nil
+}
+
+// runSiteEncrypt implements `tailpod site encrypt`: it encrypts site.env to
+// site.env.enc and removes the plaintext.
+func runSiteEncrypt(args []string) error {
+	fs := flag.NewFlagSet("tailpod site encrypt", flag.ContinueOnError)
+	siteFlag := fs.String("site", "", "site `name` under "+sitesDir+"/ (default the working directory)")
+	common := fs.Bool("common", false, "encrypt "+commonEnv+" instead of a site's site.env")
+	var recipients listFlag
+	fs.Var(&recipients, "recipient", "age (age1...) or SSH ed25519 public `key` to encrypt to; repeatable")
+	passphrase := fs.Bool("passphrase", false, "encrypt with a passphrase instead of to recipients")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (len(recipients) == 0) == !*passphrase {
+		return fmt.Errorf("give either -recipient KEY (repeatable) or -passphrase")
+	}
+	for _, r := range recipients {
+		if !strings.HasPrefix(r, "age1") && !strings.HasPrefix(r, "ssh-ed25519 ") {
+			return fmt.Errorf("recipient %q is not an age public key (age1...) or an ssh-ed25519 public key", r)
+		}
+	}
+
+	plain, err := envTarget(*siteFlag, *common)
+	if err != nil {
+		return err
+	}
+	return encryptEnvFile(plain, recipients, *passphrase)
+}
+
+// encryptEnvFile encrypts the env file plain to plain.enc, to recipients or
+// to a passphrase, and removes the plaintext.
+func encryptEnvFile(plain string, recipients []string, passphrase bool) error {
+	enc := plain + encSuffix
+	if _, err := os.Stat(enc); err == nil {
+		return fmt.Errorf("%s already exists; use tailpod site edit to change it", enc)
+	}
+	data, err := os.ReadFile(plain)
+	if err != nil {
+		return err
+	}
+
+	recipientsFile := plain + recipientsSuffix
+	if passphrase {
+		if err := os.Remove(recipientsFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		recipientsFile = ""
+	} else if err := os.WriteFile(recipientsFile, []byte(strings.Join(recipients, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := encryptEnv(enc, data, recipientsFile); err != nil {
+		return err
+	}
+	if err := os.Remove(plain); err != nil {
+		return err
+	}
+	fmt.Printf("Encrypted %s to %s and removed the plaintext\n", plain, enc)
+	return nil
+}
+
+// runSiteEdit implements `tailpod site edit`: it decrypts site.env.enc into
+// memory-backed storage, opens it in $VISUAL or $EDITOR, and re-encrypts it
+// to the same recipients (or a passphrase) if it changed.
+func runSiteEdit(args []string) error {
+	fs := flag.NewFlagSet("tailpod site edit", flag.ContinueOnError)
+	siteFlag := fs.String("site", "", "site `name` under "+sitesDir+"/ (default the working directory)")
+	common := fs.Bool("common", false, "edit "+commonEnv+encSuffix+" instead of a site's site.env.enc")
+	allowDisk := fs.Bool("allow-disk", false, "edit in the temporary directory when no memory-backed one exists")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	plain, err := envTarget(*siteFlag, *common)
+	if err != nil {
+		return err
+	}
+	return editEnvFile(plain, *allowDisk)
+}
+
+// editEnvFile edits plain.enc in place, re-encrypting it if it changed.
+// allowDisk permits a temporary directory that isn't memory-backed (see
+// editTempDir).
+func editEnvFile(plain string, allowDisk bool) error {
+	enc := plain + encSuffix
+	data, err := decryptEnv(enc)
+	if err != nil {
+		return err
+	}
+
+	parent, memory, err := editTempDir(allowDisk)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(parent, "tailpod-site-")
+	if err != nil {
+		return err
+	}
+	if !memory {
+		fmt.Fprintf(os.Stderr, "Warning: %s is not memory-backed; the decrypted copy is kept there only while you edit\n", parent)
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			os.RemoveAll(tmp)
+		}
+	}()
+	file := filepath.Join(tmp, filepath.Base(plain))
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	fields := strings.Fields(editor)
+	cmd := exec.Command(fields[0], append(fields[1:], file)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w; %s is unchanged", editor, err, enc)
+	}
+
+	edited, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, data) {
+		fmt.Printf("No changes to %s\n", enc)
+		return nil
+	}
+	if err := encryptEnv(enc, edited, recipientsFor(plain)); err != nil {
+		if !memory {
+			return fmt.Errorf("%w\n%s is unchanged, and your edits were discarded rather than left in plaintext on disk", err, enc)
+		}
+		// Don't throw the edits away; the user saves them by hand.
+		keep = true
+		return fmt.Errorf("%w\n%s is unchanged; your edits are in %s, which holds them in plaintext: delete it once they are saved", err, enc, file)
+	}
+	fmt.Printf("Re-encrypted %s\n", enc)
+	return nil
+}
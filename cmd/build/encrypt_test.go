@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeAge is an age stand-in that "encrypts" by writing a header ahead of
+// the plaintext, and logs its arguments to $AGE_LOG.
+const fakeAge = `#!/bin/sh
+echo "$@" >> "$AGE_LOG"
+case "$1" in
+--decrypt)
+	for last; do :; done
+	sed '1,3d' "$last"
+	;;
+--encrypt)
+	[ -z "$AGE_FAIL_ENCRYPT" ] || exit 1
+	out= stanza=X25519
+	while [ $# -gt 0 ]; do
+		case "$1" in
+		--output) out=$2; shift ;;
+		--passphrase) stanza=scrypt ;;
+		esac
+		shift
+	done
+	{ printf 'age-encryption.org/v1\n-> %s abc\n--- mac\n' "$stanza"; cat; } > "$out"
+	;;
+esac
+`
+
+// withFakeAge puts fakeAge first on PATH and returns the file it logs to.
+func withFakeAge(t *testing.T) string {
+	t.Helper()
+	bin := t.TempDir()
+	writeFile(t, filepath.Join(bin, "age"), fakeAge)
+	if err := os.Chmod(filepath.Join(bin, "age"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	log := filepath.Join(bin, "log")
+	t.Setenv("AGE_LOG", log)
+	return log
+}
+
+func readLog(t *testing.T, log string) string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestAgePassphrase(t *testing.T) {
+	recipient := "age-encryption.org/v1\n-> X25519 abc\nbody\n--- mac\nbinary"
+	scrypt := "age-encryption.org/v1\n-> scrypt salt 18\nbody\n--- mac\nbinary"
+	armored := ageArmorBegin + "\n" + base64.StdEncoding.EncodeToString([]byte(scrypt)) + "\n" + ageArmorEnd + "\n"
+
+	tests := []struct {
+		name, data string
+		want       bool
+		wantErr    string
+	}{
+		{"recipient", recipient, false, ""},
+		{"passphrase", scrypt, true, ""},
+		{"armored", armored, true, ""},
+		{"stanza after header", "age-encryption.org/v1\n-> X25519 abc\n--- mac\n-> scrypt", false, ""},
+		{"plaintext", "SSH_PUBKEY=key\n", false, "not an age-encrypted file"},
+		{"bad armor", ageArmorBegin + "\n!!!\n" + ageArmorEnd, false, "bad age armor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := agePassphrase([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("agePassphrase = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	s := site{dir: dir}
+	if _, err := s.envFile(); !os.IsNotExist(err) {
+		t.Errorf("no env file: error = %v, want not-exist", err)
+	}
+
+	writeFile(t, filepath.Join(dir, encryptedEnv), "")
+	if got, err := s.envFile(); err != nil || got != filepath.Join(dir, encryptedEnv) {
+		t.Errorf("envFile = %q, %v, want %s", got, err, encryptedEnv)
+	}
+
+	writeFile(t, filepath.Join(dir, "site.env"), "")
+	if _, err := s.envFile(); err == nil || !strings.Contains(err.Error(), "both") {
+		t.Errorf("both files: error = %v, want a conflict", err)
+	}
+}
+
+func TestSiteEnvLayersEncrypted(t *testing.T) {
+	log := withFakeAge(t)
+	id := filepath.Join(t.TempDir(), "key.txt")
+	t.Setenv(ageIdentityEnv, id)
+
+	dir := t.TempDir()
+	common := writeFile(t, filepath.Join(dir, commonEnv+encSuffix),
+		"age-encryption.org/v1\n-> X25519 abc\n--- mac\nTS_API_CLIENT_ID=tail1234\n")
+	enc := writeFile(t, filepath.Join(dir, encryptedEnv),
+		"age-encryption.org/v1\n-> X25519 abc\n--- mac\nTAILNET_DOMAIN=${TS_API_CLIENT_ID}.ts.net\n")
+	if got, err := plainOrEncrypted(filepath.Join(dir, commonEnv)); err != nil || got != common {
+		t.Errorf("plainOrEncrypted(common.env) = %q, %v, want %s", got, err, common)
+	}
+	l, err := siteLayers(t, filepath.Join(dir, commonEnv), enc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := l.vars["TAILNET_DOMAIN"]; got != "tail1234.ts.net" {
+		t.Errorf("TAILNET_DOMAIN = %q, want both layers decrypted", got)
+	}
+	if got := readLog(t, log); !strings.Contains(got, "--identity "+id) {
+		t.Errorf("age args = %q, want --identity %s", got, id)
+	}
+}
+
+func TestBuildAllDecryptsCommonEnvOnce(t *testing.T) {
+	log := withFakeAge(t)
+	t.Setenv(ageIdentityEnv, "key.txt")
+	dir := withWorkspace(t, "alpha", "beta", "gamma")
+	writeFile(t, filepath.Join(dir, commonEnv+encSuffix), "age-encryption.org/v1\n-> X25519 abc\n--- mac\nQUADSYNC_GIT_BRANCH=dev\n")
+
+	if err := buildAll("", buildOptions{build: "test"}); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if n := strings.Count(readLog(t, log), "--decrypt"); n != 1 {
+		t.Errorf("%s decrypted %d times, want once for all sites", commonEnv+encSuffix, n)
+	}
+}
+
+func TestSiteEncryptAndEdit(t *testing.T) {
+	log := withFakeAge(t)
+	dir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	t.Setenv(ageIdentityEnv, "key.txt")
+	writeFile(t, filepath.Join(dir, "site.env"), "TAILNET_DOMAIN=example.ts.net\n")
+
+	if err := runSite([]string{"encrypt", "-recipient", "age1abc", "-passphrase"}); err == nil {
+		t.Error("-recipient with -passphrase: want an error")
+	}
+	if err := runSite([]string{"edit", "-common", "-site", "alpha"}); err == nil {
+		t.Error("-common with -site: want an error")
+	}
+	if err := runSite([]string{"encrypt", "-recipient", "AAAA"}); err == nil {
+		t.Error("bad recipient: want an error")
+	}
+	if err := encryptEnvFile(filepath.Join(dir, "site.env"), []string{"age1abc"}, false); err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "site.env")); !os.IsNotExist(err) {
+		t.Errorf("site.env still exists after encrypt")
+	}
+	if got := readLog(t, log); !strings.Contains(got, "--recipients-file "+filepath.Join(dir, recipientsEnv)) {
+		t.Errorf("age args = %q, want --recipients-file", got)
+	}
+	if err := encryptEnvFile(filepath.Join(dir, "site.env"), nil, true); err == nil {
+		t.Error("encrypting again: want an error")
+	}
+
+	// The editor appends a line; it must see the plaintext in the
+	// memory-backed directory, not next to site.env.enc.
+	editor := writeFile(t, filepath.Join(t.TempDir(), "editor"), `#!/bin/sh
+case "$1" in "$XDG_RUNTIME_DIR"/*) ;; *) exit 1 ;; esac
+echo QUADSYNC_GIT_BRANCH=main >> "$1"
+`)
+	if err := os.Chmod(editor, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VISUAL", editor)
+	if err := editEnvFile(filepath.Join(dir, "site.env"), false); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	data, err := decryptEnv(filepath.Join(dir, encryptedEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "TAILNET_DOMAIN=example.ts.net\nQUADSYNC_GIT_BRANCH=main\n"; string(data) != want {
+		t.Errorf("after edit = %q, want %q", data, want)
+	}
+	if leftover, _ := os.ReadDir(os.Getenv("XDG_RUNTIME_DIR")); len(leftover) != 0 {
+		t.Errorf("edit left %d entries in the runtime directory", len(leftover))
+	}
+}
+
+func TestEditTempDir(t *testing.T) {
+	runtime := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtime)
+	if dir, memory, err := editTempDir(false); err != nil || dir != runtime || !memory {
+		t.Errorf("with XDG_RUNTIME_DIR: got %q, %v, %v", dir, memory, err)
+	}
+
+	// Without a memory-backed directory, as on macOS.
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	saved := shmDir
+	shmDir = filepath.Join(runtime, "missing")
+	defer func() { shmDir = saved }()
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	if _, _, err := editTempDir(false); err == nil || !strings.Contains(err.Error(), "-allow-disk") {
+		t.Errorf("no memory-backed directory: error = %v, want a refusal naming -allow-disk", err)
+	}
+	if dir, memory, err := editTempDir(true); err != nil || dir != tmp || memory {
+		t.Errorf("-allow-disk: got %q, %v, %v, want %s", dir, memory, err, tmp)
+	}
+	t.Setenv("TMPDIR", filepath.Join(runtime, "missing"))
+	if _, _, err := editTempDir(true); err == nil || !strings.Contains(err.Error(), "TMPDIR") {
+		t.Errorf("no directory: error = %v", err)
+	}
+}
+
+func TestSiteEditWhenEncryptFails(t *testing.T) {
+	withFakeAge(t)
+	runtime := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtime)
+	t.Setenv(ageIdentityEnv, "key.txt")
+	dir := t.TempDir()
+	enc := writeFile(t, filepath.Join(dir, encryptedEnv), "age-encryption.org/v1\n-> X25519 abc\n--- mac\nTAILNET_DOMAIN=example.ts.net\n")
+	editor := writeFile(t, filepath.Join(t.TempDir(), "editor"), "#!/bin/sh\necho QUADSYNC_GIT_BRANCH=main >> \"$1\"\n")
+	if err := os.Chmod(editor, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VISUAL", editor)
+	t.Setenv("AGE_FAIL_ENCRYPT", "1")
+
+	err := editEnvFile(filepath.Join(dir, "site.env"), false)
+	if err == nil {
+		t.Fatal("expected an error when age fails")
+	}
+	kept, _ := filepath.Glob(filepath.Join(runtime, "tailpod-site-*", "site.env"))
+	if len(kept) != 1 || !strings.Contains(err.Error(), kept[0]) {
+		t.Fatalf("error %q should name the kept file, found %v", err, kept)
+	}
+	if data, _ := os.ReadFile(kept[0]); !strings.Contains(string(data), "QUADSYNC_GIT_BRANCH=main") {
+		t.Errorf("kept file = %q, want the edits", data)
+	}
+	if data, _ := os.ReadFile(enc); strings.Contains(string(data), "QUADSYNC_GIT_BRANCH") {
+		t.Errorf("%s changed although encryption failed", enc)
+	}
+
+	// Outside memory-backed storage, the plaintext is never kept.
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	saved := shmDir
+	shmDir = filepath.Join(runtime, "missing")
+	defer func() { shmDir = saved }()
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	err = editEnvFile(filepath.Join(dir, "site.env"), true)
+	if err == nil || !strings.Contains(err.Error(), "discarded") {
+		t.Errorf("disk-backed: error = %v, want the edits discarded", err)
+	}
+	if leftover, _ := os.ReadDir(tmp); len(leftover) != 0 {
+		t.Errorf("edit left %d entries in %s", len(leftover), tmp)
+	}
+}
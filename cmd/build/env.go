@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// commonEnv holds values shared by every site (OAuth client, tailnet domain,
+// registry auth). It is optional and is layered under each site.env.
+const commonEnv = "common.env"
+
+// envLayers is a parsed chain of env files. Later files override earlier ones.
+type envLayers struct {
+	files  []string            // files that were read, in order
+	vars   map[string]string   // final values
+	source map[string]string   // key -> file the final value came from
+	shadow map[string][]string // key -> earlier files whose value was overridden
+	secret map[string]string   // key -> secret: reference its value comes from
+}
+
+// siteEnvLayers layers the site env file at path over common, the shared
+// common.env read by readCommonEnv (nil if there is none). Every key must be
+// in allowed. An encrypted site.env.enc is decrypted in memory (see
+// readEnvFile). A ${VAR} reference in site.env can use the values of
+// common.env. Values given as secret: references are left for
+// resolveSecrets.
+func siteEnvLayers(common *envInput, path string, allowed map[string]varType) (*envLayers, error) {
+	l := newEnvLayers()
+	if common != nil {
+		if err := l.add(common.path, common.data, allowed); err != nil {
+			return nil, err
+		}
+	}
+	data, err := readEnvFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.add(path, data, allowed); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func newEnvLayers() *envLayers {
+	return &envLayers{
+		vars:   make(map[string]string),
+		source: make(map[string]string),
+		shadow: make(map[string][]string),
+		secret: make(map[string]string),
+	}
+}
+
+// add parses data, the contents of the env file path, as the next layer.
+func (l *envLayers) add(path string, data []byte, allowed map[string]varType) error {
+	vars, secret, err := parseEnvLayer(path, string(data), allowed, l)
+	if err != nil {
+		return err
+	}
+	for k, v := range vars {
+		if prev, ok := l.source[k]; ok {
+			l.shadow[k] = append(l.shadow[k], prev)
+		}
+		l.vars[k] = v
+		l.source[k] = path
+		if ref, ok := secret[k]; ok {
+			l.secret[k] = ref
+		} else {
+			delete(l.secret, k)
+		}
+	}
+	l.files = append(l.files, path)
+	return nil
+}
+
+// envInput is an env file read ahead of parsing.
+type envInput struct {
+	path string
+	data []byte
+}
+
+// readCommonEnv reads common.env, or decrypts common.env.enc, for every
+// site of a run to share, so a passphrase is asked for once. It returns nil
+// if there is neither.
+func readCommonEnv() (*envInput, error) {
+	return readEnvInput(commonEnv)
+}
+
+// readEnvInput reads the env file path, or decrypts path.enc. It returns
+// nil if there is neither.
+func readEnvInput(path string) (*envInput, error) {
+	path, err := plainOrEncrypted(path)
+	if err == nil {
+		var data []byte
+		if data, err = readEnvFile(path); err == nil {
+			return &envInput{path: path, data: data}, nil
+		}
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return nil, err
+}
+
+// writeReport prints which file each final value came from. Values are not
+// printed since most of them are secrets.
+func (l *envLayers) writeReport(w io.Writer) {
+	keys := make([]string, 0, len(l.vars))
+	for k := range l.vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "Variables from %s:\n", strings.Join(l.files, " < "))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, k := range keys {
+		line := "  " + k + "\t" + l.source[k]
+		if ref, ok := l.secret[k]; ok {
+			line += " (" + secretPrefix + ref + ")"
+		}
+		if prev := l.shadow[k]; len(prev) > 0 {
+			line += " (overrides " + strings.Join(prev, ", ") + ")"
+		}
+		fmt.Fprintln(tw, line)
+	}
+	tw.Flush()
+}
+
+// envRef matches a ${VAR} reference in an unquoted env value.
+var envRef = regexp.MustCompile(`\$\{[A-Z_][A-Z0-9_]*\}`)
+
+// parseEnvLayer parses one env file. Each non-blank, non-comment line
+// assigns KEY=VALUE, optionally prefixed with "export " so the file can also
+// be sourced by a shell. A value is one of:
+//
+//   - unquoted: the rest of the line, trimmed, or a secret:REF reference
+//     to a value held by the secret resolver (see resolveSecrets);
+//   - single-quoted: taken literally, and may span lines;
+//   - double-quoted: may span lines, with sh's backslash escapes \\, \",
+//     \$ and \`, and a backslash at the end of a line joining it to the next.
+//     A backslash before any other character is kept, as in sh, so \n is a
+//     backslash and an n; write a real line break instead.
+//
+// Unquoted and double-quoted values expand ${OTHER} references to keys set
+// earlier in the file, or in base, the layers before it (which may be nil).
+// Setting a key twice in one file is an error. Errors give the line the
+// assignment starts on. It returns the values, and the secret: reference of
+// each key given one.
+func parseEnvLayer(name, data string, allowed map[string]varType, base *envLayers) (map[string]string, map[string]string, error) {
+	vars := make(map[string]string)
+	secret := make(map[string]string)
+	setOn := make(map[string]int) // key -> line it was set on
+	lookup := func(ref string) (string, error) {
+		v, ok := vars[ref]
+		_, isSecret := secret[ref]
+		if !ok && base != nil {
+			v, ok = base.vars[ref]
+			_, isSecret = base.secret[ref]
+		}
+		switch {
+		case !ok:
+			return "", fmt.Errorf("${%s} is not set above this line", ref)
+		case isSecret:
+			return "", fmt.Errorf("${%s} is a %s reference, which can't be used in another value", ref, secretPrefix)
+		}
+		return v, nil
+	}
+
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		// Only the left is trimmed: a quoted value that goes on to the next
+		// line keeps the trailing blanks of its first line.
+		line := strings.TrimLeft(lines[i], " \t")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "export"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			line = strings.TrimLeft(rest, " \t")
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, nil, fmt.Errorf("%s line %d: not a KEY=VALUE assignment: %q", name, n, strings.TrimSpace(line))
+		}
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, nil, fmt.Errorf("%s line %d: empty key", name, n)
+		}
+		// Reject keys with characters that aren't valid env var names
+		for _, c := range key {
+			if !((c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_') {
+				return nil, nil, fmt.Errorf("%s line %d: invalid character %q in key %q", name, n, string(c), key)
+			}
+		}
+		typ, ok := allowed[key]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s line %d: unknown variable %q (not in allowlist)", name, n, key)
+		}
+		if prev, ok := setOn[key]; ok {
+			return nil, nil, fmt.Errorf("%s line %d: %s is already set on line %d", name, n, key, prev)
+		}
+
+		var err error
+		value = strings.TrimLeft(value, " \t")
+		if ref, ok := strings.CutPrefix(strings.TrimSpace(value), secretPrefix); ok {
+			if err := checkSecretRef(ref, typ); err != nil {
+				return nil, nil, fmt.Errorf("%s line %d: %s: %w", name, n, key, err)
+			}
+			vars[key] = ""
+			secret[key] = ref
+			setOn[key] = n
+			continue
+		}
+		if value != "" && (value[0] == '"' || value[0] == '\'') {
+			value, i, err = quotedValue(lines, i, value, lookup)
+		} else {
+			value, err = expandEnvRefs(strings.TrimSpace(value), lookup)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s line %d: %s: %w", name, n, key, err)
+		}
+		if err := typ.check(value); err != nil {
+			return nil, nil, fmt.Errorf("%s line %d: %s: %w", name, n, key, err)
+		}
+		vars[key] = value
+		setOn[key] = n
+	}
+	return vars, secret, nil
+}
+
+// quotedValue reads the quoted value that starts at rest, the text after
+// "KEY=" on lines[i], continuing over following lines until the closing
+// quote. It returns the value and the index of the line that closes it.
+func quotedValue(lines []string, i int, rest string, lookup func(string) (string, error)) (string, int, error) {
+	q := rest[0]
+	s := rest[1:]
+	var sb strings.Builder
+	for {
+		joined := false
+		for j := 0; j < len(s); j++ {
+			c := s[j]
+			switch {
+			case c == q:
+				if tail := strings.TrimSpace(s[j+1:]); tail != "" && !strings.HasPrefix(tail, "#") {
+					return "", i, fmt.Errorf("unexpected text after the closing %c", q)
+				}
+				return sb.String(), i, nil
+			case q == '\'':
+				sb.WriteByte(c)
+			case c == '\\':
+				if j == len(s)-1 {
+					// The value goes on without a line break.
+					joined = true
+					continue
+				}
+				j++
+				switch s[j] {
+				case '\\', '"', '$', '`':
+					sb.WriteByte(s[j])
+				default:
+					// Kept as written, as sh does: "C:\Users" is C:\Users
+					// and "a\nb" is a backslash and an n, not a line break.
+					sb.WriteByte('\\')
+					sb.WriteByte(s[j])
+				}
+			case c == '$' && strings.HasPrefix(s[j:], "${"):
+				end := strings.IndexByte(s[j:], '}')
+				if end < 0 || !envVarName.MatchString(s[j+2:j+end]) {
+					sb.WriteByte(c)
+					continue
+				}
+				v, err := lookup(s[j+2 : j+end])
+				if err != nil {
+					return "", i, err
+				}
+				sb.WriteString(v)
+				j += end
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		i++
+		if i >= len(lines) {
+			return "", i, fmt.Errorf("no closing %c", q)
+		}
+		if !joined {
+			sb.WriteByte('\n')
+		}
+		s = lines[i]
+	}
+}
+
+// expandEnvRefs expands the ${OTHER} references in an unquoted value.
+func expandEnvRefs(value string, lookup func(string) (string, error)) (string, error) {
+	var errs []error
+	expanded := envRef.ReplaceAllStringFunc(value, func(ref string) string {
+		v, err := lookup(ref[2 : len(ref)-1])
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return v
+	})
+	return expanded, errors.Join(errs...)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, data string) string {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// siteLayers layers site over the common.env at common, or common.env.enc
+// beside it, the way buildSite does.
+func siteLayers(t *testing.T, common, site string) (*envLayers, error) {
+	t.Helper()
+	c, err := readEnvInput(common)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return siteEnvLayers(c, site, testAllowed(t))
+}
+
+func TestSiteEnvLayersOverrides(t *testing.T) {
+	dir := t.TempDir()
+	common := writeFile(t, filepath.Join(dir, "common.env"), `TAILNET_DOMAIN=example.ts.net
+QUADSYNC_GIT_BRANCH=main
+`)
+	site := writeFile(t, filepath.Join(dir, "site.env"), `SSH_PUBKEY=key
+QUADSYNC_GIT_BRANCH=staging
+`)
+
+	l, err := siteLayers(t, common, site)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := l.vars["QUADSYNC_GIT_BRANCH"]; got != "staging" {
+		t.Errorf("QUADSYNC_GIT_BRANCH = %q, want later file to win", got)
+	}
+	if got := l.vars["TAILNET_DOMAIN"]; got != "example.ts.net" {
+		t.Errorf("TAILNET_DOMAIN = %q, want inherited from common.env", got)
+	}
+	if got := l.source["QUADSYNC_GIT_BRANCH"]; got != site {
+		t.Errorf("source = %q, want %q", got, site)
+	}
+	if got := l.source["TAILNET_DOMAIN"]; got != common {
+		t.Errorf("source = %q, want %q", got, common)
+	}
+	if got := l.shadow["QUADSYNC_GIT_BRANCH"]; len(got) != 1 || got[0] != common {
+		t.Errorf("shadow = %v, want [%s]", got, common)
+	}
+}
+
+func TestSiteEnvLayersMissing(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "common.env")
+	site := writeFile(t, filepath.Join(dir, "site.env"), "SSH_PUBKEY=key\n")
+
+	l, err := siteLayers(t, missing, site)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(l.files) != 1 || l.files[0] != site {
+		t.Errorf("files = %v, want only %s", l.files, site)
+	}
+
+	if _, err := siteLayers(t, site, filepath.Join(dir, "other.env")); !os.IsNotExist(err) {
+		t.Errorf("missing site env: err = %v, want not exist", err)
+	}
+}
+
+func TestSiteEnvLayersErrorNamesFile(t *testing.T) {
+	dir := t.TempDir()
+	common := writeFile(t, filepath.Join(dir, "common.env"), "# shared\nBOGUS=1\n")
+	site := writeFile(t, filepath.Join(dir, "site.env"), "SSH_PUBKEY=key\n")
+
+	_, err := siteLayers(t, common, site)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), common+" line 2") {
+		t.Errorf("error %q should name %s line 2", err, common)
+	}
+}
+
+func TestEnvLayersReport(t *testing.T) {
+	dir := t.TempDir()
+	common := writeFile(t, filepath.Join(dir, "common.env"), "TS_API_CLIENT_SECRET=hunter2\nQUADSYNC_GIT_BRANCH=main\n")
+	site := writeFile(t, filepath.Join(dir, "site.env"), "QUADSYNC_GIT_BRANCH=dev\n")
+
+	l, err := siteLayers(t, common, site)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	l.writeReport(&buf)
+	out := buf.String()
+
+	if strings.Contains(out, "hunter2") {
+		t.Error("report must not contain values")
+	}
+	want := map[string]string{
+		"QUADSYNC_GIT_BRANCH":  site + " (overrides " + common + ")",
+		"TS_API_CLIENT_SECRET": common,
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if w, ok := want[fields[0]]; ok {
+			if got := strings.Join(fields[1:], " "); got != w {
+				t.Errorf("%s: got %q, want %q", fields[0], got, w)
+			}
+			delete(want, fields[0])
+		}
+	}
+	for k := range want {
+		t.Errorf("report missing %s:\n%s", k, out)
+	}
+}
+
+func TestParseEnvLayerSyntax(t *testing.T) {
+	input := `export QUADSYNC_GIT_BRANCH=main
+QUADSYNC_AGE_KEY="-----BEGIN KEY-----
+line two
+-----END KEY-----"  # trailing comment
+SSH_PUBKEY='ssh-ed25519 $literal ${NOT_EXPANDED} \n'
+TAILNET_DOMAIN="no\tescapes\n\r \"quoted\" \$HOME \${QUADSYNC_GIT_BRANCH} ${QUADSYNC_GIT_BRANCH} \q\. \
+joined"
+QUADSYNC_GIT_URL=git@${TS_API_CLIENT_ID}:org/repo.git
+STORAGE_SMB_PASSWORD='two
+lines'
+STORAGE_SMB_USER="first   ` + `
+second  ` + `
+third"   ` + `
+`
+	base := &envLayers{vars: map[string]string{"TS_API_CLIENT_ID": "github.com"}}
+	vars, _, err := parseEnvLayer("site.env", input, testAllowed(t), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"QUADSYNC_GIT_BRANCH":  "main",
+		"QUADSYNC_AGE_KEY":     "-----BEGIN KEY-----\nline two\n-----END KEY-----",
+		"SSH_PUBKEY":           `ssh-ed25519 $literal ${NOT_EXPANDED} \n`,
+		"TAILNET_DOMAIN":       `no\tescapes\n\r "quoted" $HOME ${QUADSYNC_GIT_BRANCH} main \q\. joined`,
+		"QUADSYNC_GIT_URL":     "git@github.com:org/repo.git",
+		"STORAGE_SMB_PASSWORD": "two\nlines",
+		"STORAGE_SMB_USER":     "first   \nsecond  \nthird",
+	}
+	for k, w := range want {
+		if vars[k] != w {
+			t.Errorf("%s = %q, want %q", k, vars[k], w)
+		}
+	}
+	if len(vars) != len(want) {
+		t.Errorf("got %d vars, want %d", len(vars), len(want))
+	}
+}
+
+func TestParseEnvLayerShEscapes(t *testing.T) {
+	// A file sourced by sh must give tailpod the same values: only \\, \",
+	// \$ and \` are escapes inside double quotes.
+	tests := []struct {
+		input, want string
+	}{
+		{`"a\nb"`, `a\nb`},
+		{`"a\tb\rc"`, `a\tb\rc`},
+		{`"a\\b"`, `a\b`},
+		{`"\"\$x"`, `"$x`},
+		{"\"\\`date\\`\"", "`date`"},
+	}
+	for _, tt := range tests {
+		vars, _, err := parseEnvLayer("site.env", "TAILNET_DOMAIN="+tt.input+"\n", testAllowed(t), nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.input, err)
+			continue
+		}
+		if got := vars["TAILNET_DOMAIN"]; got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseEnvLayerErrors(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"QUADSYNC_GIT_BRANCH=main\n\nQUADSYNC_GIT_BRANCH=dev\n", "site.env line 3: QUADSYNC_GIT_BRANCH is already set on line 1"},
+		{"SSH_PUBKEY=key\nQUADSYNC_AGE_KEY=\"-----BEGIN\nnever closed\n", `site.env line 2: QUADSYNC_AGE_KEY: no closing "`},
+		{`TAILNET_DOMAIN="a" b`, `site.env line 1: TAILNET_DOMAIN: unexpected text after the closing "`},
+		{"TAILNET_DOMAIN=${TS_API_CLIENT_ID}.ts.net\nTS_API_CLIENT_ID=x\n", "site.env line 1: TAILNET_DOMAIN: ${TS_API_CLIENT_ID} is not set above this line"},
+		{"\n\nSTORAGE_SMB_HOST=\"${STORAGE_SMB_HOST}\"", "site.env line 3: STORAGE_SMB_HOST: ${STORAGE_SMB_HOST} is not set above this line"},
+	}
+	for _, tt := range tests {
+		_, _, err := parseEnvLayer("site.env", tt.input, testAllowed(t), nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("input %q: got %v, want %q", tt.input, err, tt.want)
+		}
+	}
+}
+
+func TestSiteEnvLayersReferences(t *testing.T) {
+	dir := t.TempDir()
+	common := writeFile(t, filepath.Join(dir, "common.env"), "TS_API_CLIENT_ID=tail1234\n")
+	site := writeFile(t, filepath.Join(dir, "site.env"), "TAILNET_DOMAIN=${TS_API_CLIENT_ID}.ts.net\n")
+	l, err := siteLayers(t, common, site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.vars["TAILNET_DOMAIN"]; got != "tail1234.ts.net" {
+		t.Errorf("TAILNET_DOMAIN = %q", got)
+	}
+}
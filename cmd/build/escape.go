@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// filters are the escapes a substitution can name, as in ${VAR|yaml}. Each
+// turns a site.env value into text that is safe in one kind of context, or
+// fails if no escaping can make it safe there.
+var filters = map[string]func(string) (string, error){
+	// yaml quotes the value as a YAML scalar: key: ${VAR|yaml}
+	"yaml": func(v string) (string, error) {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		// A JSON string is a valid YAML double-quoted scalar.
+		if err := enc.Encode(v); err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(buf.String(), "\n"), nil
+	},
+	// sudoers backslash-escapes everything but word characters, so a value
+	// stays one word in a sudoers rule.
+	"sudoers": func(v string) (string, error) {
+		if strings.ContainsFunc(v, unicode.IsControl) {
+			return "", errors.New("value has a line break or control character, which a sudoers rule can't hold")
+		}
+		var sb strings.Builder
+		for _, r := range v {
+			if !sudoersWord(r) {
+				sb.WriteByte('\\')
+			}
+			sb.WriteRune(r)
+		}
+		return sb.String(), nil
+	},
+	// ini makes the value safe as a systemd or Quadlet unit setting: % is
+	// doubled so it isn't read as a specifier.
+	"ini": func(v string) (string, error) {
+		if strings.ContainsFunc(v, unicode.IsControl) {
+			return "", errors.New("value has a line break or control character, which a unit file setting can't hold")
+		}
+		if strings.HasSuffix(v, `\`) {
+			return "", errors.New(`value ends in \, which continues a unit file setting onto the next line`)
+		}
+		return strings.ReplaceAll(v, "%", "%%"), nil
+	},
+	// urlpath percent-encodes the value as one URL path segment.
+	"urlpath": func(v string) (string, error) {
+		return url.PathEscape(v), nil
+	},
+	// base64 encodes the value with standard padding.
+	"base64": func(v string) (string, error) {
+		return base64.StdEncoding.EncodeToString([]byte(v)), nil
+	},
+}
+
+// applyFilter runs the named filter over v.
+func applyFilter(name, v string) (string, error) {
+	f, ok := filters[name]
+	if !ok {
+		return "", fmt.Errorf("unknown filter %q (want yaml, sudoers, ini, urlpath or base64)", name)
+	}
+	return f(v)
+}
+
+// sudoersWord reports whether r can appear unescaped in a sudoers word.
+func sudoersWord(r rune) bool {
+	return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_./+@-", r))
+}
+
+// textContext is the kind of text a ${VAR} lands in.
+type textContext int
+
+const (
+	contextNone    textContext = iota // comments, or a value that needs no escaping
+	contextYAML                       // a YAML scalar outside block scalars
+	contextText                       // a block scalar holding a plain file
+	contextINI                        // a block scalar holding a unit file
+	contextSudoers                    // a block scalar holding a sudoers.d file
+)
+
+// yamlSpecial matches plain scalars YAML reads as something other than a
+// string: booleans, null and numbers.
+var yamlSpecial = regexp.MustCompile(`^(?i:true|false|yes|no|on|off|y|n|null|~|[-+]?\.(inf|nan)|[-+]?[0-9][0-9_]*(\.[0-9_]*)?(e[-+]?[0-9]+)?|[-+]?\.[0-9]+(e[-+]?[0-9]+)?|0x[0-9a-f]+|0o[0-7]+)$`)
+
+// unescaped returns why v isn't safe to substitute into c without a filter,
+// and the filter that makes it safe, or "" if it is safe. The check is
+// conservative: a value it passes is read back unchanged.
+func (c textContext) unescaped(v string) (reason, filter string) {
+	switch c {
+	case contextYAML:
+		if v == "" || v != strings.TrimSpace(v) || yamlSpecial.MatchString(v) ||
+			strings.ContainsAny(v[:1], "-?:,[]{}#&*!|>'\"%@`") ||
+			strings.Contains(v, ": ") || strings.Contains(v, " #") || strings.HasSuffix(v, ":") ||
+			strings.ContainsFunc(v, unicode.IsControl) {
+			return "is substituted into a YAML value, and its value needs quoting", "yaml"
+		}
+	case contextText:
+		if strings.ContainsAny(v, "\r\n") {
+			return "has a line break, which ends the YAML block it is substituted into", ""
+		}
+	case contextINI:
+		if strings.ContainsRune(v, '%') || strings.HasSuffix(v, `\`) || strings.ContainsFunc(v, unicode.IsControl) {
+			return "is substituted into a unit file, and its value has a %, a trailing \\ or a line break", "ini"
+		}
+	case contextSudoers:
+		if strings.ContainsFunc(v, func(r rune) bool { return !sudoersWord(r) }) {
+			return "is substituted into a sudoers rule, and its value has characters sudoers treats specially", "sudoers"
+		}
+	}
+	return "", ""
+}
+
+var (
+	// blockStart matches a line that opens a YAML block scalar, "key: |".
+	blockStart = regexp.MustCompile(`:\s*[|>][-+0-9]*\s*(#.*)?$`)
+	// sectionHeader matches a unit file section, "[Service]".
+	sectionHeader = regexp.MustCompile(`^\[[A-Za-z][A-Za-z0-9 -]*\]$`)
+)
+
+// contextTracker follows a .bu file line by line to tell what kind of text
+// each line is. Files under /etc/sudoers.d/ are sudoers rules, and a block
+// scalar becomes a unit file at its first section header.
+type contextTracker struct {
+	path        string // "path:" of the current list entry
+	inBlock     bool
+	blockIndent int // indentation of the key that opened the block
+	block       textContext
+}
+
+// next returns the context of line, the next line of the file.
+func (t *contextTracker) next(line string) textContext {
+	trimmed := strings.TrimSpace(line)
+	indent := len(line) - len(strings.TrimLeft(line, " "))
+	if t.inBlock {
+		if trimmed == "" || indent > t.blockIndent {
+			if t.block == contextText && sectionHeader.MatchString(trimmed) {
+				t.block = contextINI
+			}
+			return t.block
+		}
+		t.inBlock = false
+	}
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return contextNone
+	}
+	item, isItem := strings.CutPrefix(trimmed, "- ")
+	if isItem {
+		t.path = ""
+		indent += 2
+	}
+	if p, ok := strings.CutPrefix(item, "path:"); ok {
+		t.path = strings.Trim(strings.TrimSpace(p), `"'`)
+	}
+	if blockStart.MatchString(item) {
+		t.inBlock, t.blockIndent, t.block = true, indent, contextText
+		if strings.HasPrefix(t.path, "/etc/sudoers.d/") {
+			t.block = contextSudoers
+		}
+		return contextNone
+	}
+	return contextYAML
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	tests := []struct {
+		filter, in, want string
+	}{
+		{"yaml", "plain", `"plain"`},
+		{"yaml", "a \"b\"\n<c>", `"a \"b\"\n<c>"`},
+		{"sudoers", "ops-team_1", "ops-team_1"},
+		{"sudoers", `a b,c:d=e!f(g)\`, `a\ b\,c\:d\=e\!f\(g\)\\`},
+		{"ini", "100% done", "100%% done"},
+		{"urlpath", "a b/c?", "a%20b%2Fc%3F"},
+		{"base64", "user:token", "dXNlcjp0b2tlbg=="},
+	}
+	for _, tt := range tests {
+		got, err := applyFilter(tt.filter, tt.in)
+		if err != nil {
+			t.Errorf("%s(%q): %v", tt.filter, tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s(%q) = %q, want %q", tt.filter, tt.in, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ filter, in string }{
+		{"sudoers", "a\nb"},
+		{"ini", "a\nb"},
+		{"ini", `trailing\`},
+		{"shell", "x"},
+	} {
+		if _, err := applyFilter(tt.filter, tt.in); err == nil {
+			t.Errorf("%s(%q): expected an error", tt.filter, tt.in)
+		}
+	}
+}
+
+func TestUnescapedYAML(t *testing.T) {
+	for _, v := range []string{"ssh-ed25519 AAAA you@example.com", "https://example.com/x:1", "sha512-abc", "/etc/tailpod", "AGE-SECRET-KEY-1QQ"} {
+		if reason, _ := contextYAML.unescaped(v); reason != "" {
+			t.Errorf("%q: unexpected %q", v, reason)
+		}
+	}
+	for _, v := range []string{"", "true", "No", "null", "1234567", "1e5", "0x1f", " lead", "key: value", "a #comment", "'quoted", "*alias", "- item", "multi\nline"} {
+		if reason, _ := contextYAML.unescaped(v); reason == "" {
+			t.Errorf("%q: expected it to need quoting", v)
+		}
+	}
+}
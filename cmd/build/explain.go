@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// Policies recorded for a part that merged into an entry an earlier part
+// already declared.
+const (
+	explainConcat   = "concat"   // inline file contents appended
+	explainSections = "sections" // transform merged section by section
+	explainOverride = "override" // file contents replaced
+	explainGrouped  = "grouped"  // fields combined into one entry
+)
+
+// contribution is one part's share in a merged entry. Policy is empty for
+// the part that first declared the entry.
+type contribution struct {
+	Part   string `json:"part"`
+	Policy string `json:"policy,omitempty"`
+}
+
+// provenance records which parts contributed each entry of a merged config.
+type provenance map[string][]contribution // entryKey -> contributions in merge order
+
+// add records that part contributed to the entry at key. A part merging into
+// an entry twice (a duplicate within one .bu file) is recorded once, with
+// its latest policy.
+func (p provenance) add(key, part, policy string) {
+	c := p[key]
+	if n := len(c); n > 0 && c[n-1].Part == part {
+		if policy != "" {
+			c[n-1].Policy = policy
+		}
+		return
+	}
+	p[key] = append(c, contribution{Part: part, Policy: policy})
+}
+
+// explainFormat is the --explain flag: bare --explain selects text,
+// --explain=json selects JSON.
+type explainFormat string
+
+func (f *explainFormat) String() string { return string(*f) }
+
+func (f *explainFormat) IsBoolFlag() bool { return true }
+
+func (f *explainFormat) Set(v string) error {
+	switch v {
+	case "true", "text":
+		*f = "text"
+	case "false":
+		*f = ""
+	case "json":
+		*f = "json"
+	default:
+		return fmt.Errorf("unknown format %q (want text or json)", v)
+	}
+	return nil
+}
+
+// explainEntry is one line of the provenance report.
+type explainEntry struct {
+	Entry   string         `json:"entry"`
+	Sources []contribution `json:"sources"`
+}
+
+// entries returns the provenance of every entry, sorted by entry key.
+func (p provenance) entries() []explainEntry {
+	keys := make([]string, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entries := make([]explainEntry, 0, len(keys))
+	for _, k := range keys {
+		entries = append(entries, explainEntry{Entry: k, Sources: p[k]})
+	}
+	return entries
+}
+
+// writeExplain prints the provenance of every entry in an output as text.
+func writeExplain(w io.Writer, output string, p provenance) error {
+	fmt.Fprintf(w, "Provenance of %s:\n", output)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, e := range p.entries() {
+		var parts []string
+		for _, c := range e.Sources {
+			if c.Policy != "" {
+				parts = append(parts, c.Part+" ("+c.Policy+")")
+			} else {
+				parts = append(parts, c.Part)
+			}
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", e.Entry, strings.Join(parts, ", "))
+	}
+	return tw.Flush()
+}
+
+// explainReport collects the provenance of every output of a run for
+// --explain=json, which prints it as one JSON document once all sites are
+// built. Sites build in parallel, so add is safe for concurrent use.
+type explainReport struct {
+	mu      sync.Mutex
+	Outputs []explainOutput `json:"outputs"`
+}
+
+// explainOutput is the provenance of one Ignition file.
+type explainOutput struct {
+	Site    string         `json:"site,omitempty"`
+	Arch    string         `json:"arch"`
+	Output  string         `json:"output"`
+	Entries []explainEntry `json:"entries"`
+}
+
+func (r *explainReport) add(site, arch, output string, p provenance) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Outputs = append(r.Outputs, explainOutput{Site: site, Arch: arch, Output: output, Entries: p.entries()})
+}
+
+// write prints the report, with outputs sorted by file name.
+func (r *explainReport) write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Outputs == nil {
+		r.Outputs = []explainOutput{}
+	}
+	sort.Slice(r.Outputs, func(i, j int) bool { return r.Outputs[i].Output < r.Outputs[j].Output })
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExplainProvenance(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"storage": {
+    "directories": [{"path": "/etc/quadsync"}],
+    "files": [
+      {"path": "/etc/quadsync/transforms/_base.container", "contents": {"source": "data:,%5BContainer%5D%0ALabel=a%0A"}},
+      {"path": "/etc/motd", "contents": {"source": "data:,hello%0A"}},
+      {"path": "/usr/local/bin/quadsync", "contents": {"source": "https://example.com/a"}}]},
+  "passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["k1"]}]}}`)},
+		{name: "server.bu", ign: []byte(`{"storage": {
+    "directories": [{"path": "/etc/quadsync"}],
+    "files": [
+      {"path": "/etc/quadsync/transforms/_base.container", "contents": {"source": "data:,%5BContainer%5D%0ALabel=b%0A"}},
+      {"path": "/etc/motd", "contents": {"source": "data:,world%0A"}},
+      {"path": "/usr/local/bin/quadsync", "contents": {"source": "https://example.com/b"}}]},
+  "passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["k2"]}]},
+  "systemd": {"units": [{"name": "smb.service", "enabled": true}]}}`)},
+	}
+	m, err := mergeParts(parts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeExplain(&buf, "tailpod.ign", m.sources); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n")[1:] {
+		fields := strings.Fields(line)
+		got[strings.Join(fields[:2], " ")] = strings.Join(fields[2:], " ")
+	}
+	for entry, want := range map[string]string{
+		"storage.directories /etc/quadsync":                      "tailpod.bu, server.bu (grouped)",
+		"storage.files /etc/quadsync/transforms/_base.container": "tailpod.bu, server.bu (sections)",
+		"storage.files /etc/motd":                                "tailpod.bu, server.bu (concat)",
+		"storage.files /usr/local/bin/quadsync":                  "tailpod.bu, server.bu (override)",
+		"passwd.users core":                                      "tailpod.bu, server.bu (grouped)",
+		"systemd.units smb.service":                              "server.bu",
+	} {
+		if got[entry] != want {
+			t.Errorf("%s: got %q, want %q", entry, got[entry], want)
+		}
+	}
+	if len(got) != 6 {
+		t.Errorf("got %d entries, want 6:\n%s", len(got), buf.String())
+	}
+
+	var report explainReport
+	report.add("alpha", "arm64", "out/alpha.ign", m.sources)
+	buf.Reset()
+	if err := report.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var got2 struct {
+		Outputs []explainOutput
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got2); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+	if len(got2.Outputs) != 1 || got2.Outputs[0].Site != "alpha" || len(got2.Outputs[0].Entries) != 6 {
+		t.Fatalf("report = %+v", got2)
+	}
+	if e := got2.Outputs[0].Entries[0]; e.Entry != "passwd.users core" || len(e.Sources) != 2 || e.Sources[1].Policy != explainGrouped {
+		t.Errorf("first entry = %+v", e)
+	}
+}
+
+// TestExplainJSONStdout builds two sites with a stand-in butane and checks
+// that stdout holds one JSON document and nothing else.
+func TestExplainJSONStdout(t *testing.T) {
+	withWorkspace(t, "alpha", "beta")
+
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	saved := os.Stdout
+	os.Stdout = stdout
+	err = runBuild([]string{"--explain=json", "-show-env"})
+	os.Stdout = saved
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	data, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Outputs []explainOutput
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("stdout is not one JSON document: %v\n%s", err, data)
+	}
+	if len(report.Outputs) != 2 || report.Outputs[0].Site != "alpha" || report.Outputs[1].Site != "beta" {
+		t.Errorf("outputs = %+v", report.Outputs)
+	}
+}
+
+func TestExplainFlag(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"--explain"}, "text"},
+		{[]string{"--explain=json"}, "json"},
+		{[]string{"--explain=text"}, "text"},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		var f explainFormat
+		fs.Var(&f, "explain", "")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if string(f) != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.args, f, tt.want)
+		}
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(&bytes.Buffer{})
+	var f explainFormat
+	fs.Var(&f, "explain", "")
+	if err := fs.Parse([]string{"--explain=yaml"}); err == nil {
+		t.Error("expected error for unknown format")
+	}
+
+	for args, want := range map[string]string{
+		"--explain json": `unexpected argument "json"; write --explain=json`,
+		"-strict alpha":  `unexpected argument "alpha"`,
+	} {
+		if err := runBuild(strings.Fields(args)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error = %v, want %q", args, err, want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// unitDir is where Ignition writes systemd units, relative to the root.
+const unitDir = "etc/systemd/system"
+
+// redactedContents replaces secret file contents under --redact.
+const redactedContents = "<redacted by tailpod extract>\n"
+
+// runExtract implements `tailpod extract tailpod.ign --to DIR`.
+func runExtract(args []string) error {
+	fl := flag.NewFlagSet("tailpod extract", flag.ContinueOnError)
+	to := fl.String("to", "", "empty or missing `directory` to write the rendered tree into")
+	redact := fl.Bool("redact", false, "replace the contents of credential files with a placeholder")
+	positional, err := parseInterspersed(fl, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || *to == "" {
+		return fmt.Errorf("usage: tailpod extract FILE.ign --to DIR [--redact]")
+	}
+	doc, err := loadIgnition(positional[0])
+	if err != nil {
+		return err
+	}
+	n, err := extractIgnition(doc, *to, *redact)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Extracted %d entries to %s\n", n, *to)
+	return nil
+}
+
+// extractIgnition writes the config's directories, files, links and units as
+// a filesystem tree under root, which must be empty or not yet exist. Remote
+// files become stubs recording their URL and hash. It returns the number of
+// entries written.
+//
+// Nothing is written outside root: regular files and units go first, and
+// no write goes through an existing symlink. Links come after them, and a
+// link whose target is absolute or outside root becomes a stub recording
+// the target. Directory modes are applied last, so that a read-only
+// directory doesn't block the entries under it.
+func extractIgnition(doc map[string]any, root string, redact bool) (int, error) {
+	if entries, err := os.ReadDir(root); err == nil && len(entries) > 0 {
+		return 0, fmt.Errorf("%s is not empty; remove it first", root)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return 0, err
+	}
+	root = filepath.Clean(root)
+
+	n := 0
+	type dirMode struct {
+		path  string
+		entry map[string]any
+	}
+	var dirs []dirMode
+	for _, m := range ignEntries(doc, "storage", "directories") {
+		dst, err := extractPath(root, m["path"])
+		if err != nil {
+			return n, err
+		}
+		if err := mkdirInside(root, dst); err != nil {
+			return n, err
+		}
+		dirs = append(dirs, dirMode{dst, m})
+		n++
+	}
+
+	for _, m := range ignEntries(doc, "storage", "files") {
+		dst, err := extractPath(root, m["path"])
+		if err != nil {
+			return n, err
+		}
+		text, err := extractFileContents(m, redact)
+		if err != nil {
+			return n, fmt.Errorf("%v: %w", m["path"], err)
+		}
+		if err := writeExtracted(root, dst, text, m, 0644); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	var masked []string
+	for _, m := range ignEntries(doc, "systemd", "units") {
+		name, _ := m["name"].(string)
+		if name == "" || strings.ContainsRune(name, '/') {
+			return n, fmt.Errorf("invalid unit name %q", name)
+		}
+		dst := filepath.Join(root, unitDir, name)
+		if mask, _ := m["mask"].(bool); mask {
+			masked = append(masked, dst)
+		} else if contents, ok := m["contents"].(string); ok {
+			if err := writeExtracted(root, dst, contents, nil, 0644); err != nil {
+				return n, err
+			}
+		}
+		for _, d := range asSlice(m["dropins"]) {
+			dm, _ := d.(map[string]any)
+			dn, _ := dm["name"].(string)
+			if dn == "" || strings.ContainsRune(dn, '/') {
+				return n, fmt.Errorf("unit %s: invalid dropin name %q", name, dn)
+			}
+			contents, _ := dm["contents"].(string)
+			if err := writeExtracted(root, filepath.Join(root, unitDir, name+".d", dn), contents, nil, 0644); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+
+	for _, m := range ignEntries(doc, "storage", "links") {
+		dst, err := extractPath(root, m["path"])
+		if err != nil {
+			return n, err
+		}
+		target, _ := m["target"].(string)
+		hard, _ := m["hard"].(bool)
+		if err := linkInside(root, dst, target, hard); err != nil {
+			return n, err
+		}
+		n++
+	}
+	for _, dst := range masked {
+		if err := linkInside(root, dst, "/dev/null", false); err != nil {
+			return n, err
+		}
+	}
+
+	// Deepest directories first, whatever their order in the config, so
+	// that a parent's mode can't stop its children from being changed.
+	slices.SortStableFunc(dirs, func(a, b dirMode) int {
+		return strings.Count(b.path, string(filepath.Separator)) - strings.Count(a.path, string(filepath.Separator))
+	})
+	for _, d := range dirs {
+		if err := chmodEntry(d.path, d.entry, 0755); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checkInside fails if any existing component of dst below root is a
+// symlink, so that writing dst can't end up outside root.
+func checkInside(root, dst string) error {
+	rel, err := filepath.Rel(root, dst)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside %s", dst, root)
+	}
+	p := root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%s: refusing to write through the symlink %s", dst, p)
+		}
+	}
+	return nil
+}
+
+// mkdirInside creates dir and its parents under root.
+func mkdirInside(root, dir string) error {
+	if err := checkInside(root, dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// linkInside creates a symlink at dst. A hard link, or a symlink whose
+// target is absolute or resolves outside root, becomes a stub recording
+// the target instead.
+func linkInside(root, dst, target string, hard bool) error {
+	if err := mkdirInside(root, filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := checkInside(root, dst); err != nil {
+		return err
+	}
+	switch {
+	case hard:
+		return os.WriteFile(dst, []byte("# hard link to "+target+"\n"), 0644)
+	case target == "" || filepath.IsAbs(target) || checkInside(root, filepath.Join(filepath.Dir(dst), target)) != nil:
+		return os.WriteFile(dst, []byte("# symlink to "+target+"\n"), 0644)
+	}
+	return os.Symlink(target, dst)
+}
+
+// extractPath maps an absolute Ignition path into root, refusing relative
+// paths. Cleaning it as an absolute path first keeps ".." inside root.
+func extractPath(root string, v any) (string, error) {
+	p, _ := v.(string)
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("path %q is not absolute", p)
+	}
+	return filepath.Join(root, filepath.FromSlash(filepath.Clean(p))), nil
+}
+
+// extractFileContents returns what to write for a storage.files entry:
+// the decoded inline contents (plus any appended fragments), a stub for
+// remote sources, or a placeholder for secrets when redacting.
+func extractFileContents(m map[string]any, redact bool) (string, error) {
+	if redact && isSecretFile(m) {
+		return redactedContents, nil
+	}
+
+	var sb strings.Builder
+	if r := remoteSource(m); r != "" {
+		writeRemoteStub(&sb, m["contents"])
+	} else if _, ok := m["contents"]; ok {
+		text, err := decodeDataURI(m)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(text)
+	}
+	for _, a := range asSlice(m["append"]) {
+		frag := map[string]any{"contents": a}
+		if remoteSource(frag) != "" {
+			writeRemoteStub(&sb, a)
+			continue
+		}
+		text, err := decodeDataURI(frag)
+		if err != nil {
+			return "", fmt.Errorf("append: %w", err)
+		}
+		sb.WriteString(text)
+	}
+	return sb.String(), nil
+}
+
+// writeRemoteStub records a remote source instead of its (unfetched) contents.
+func writeRemoteStub(sb *strings.Builder, contents any) {
+	c, _ := contents.(map[string]any)
+	fmt.Fprintf(sb, "# tailpod extract: fetched by Ignition at first boot\nsource: %v\n", c["source"])
+	if v, ok := c["verification"].(map[string]any); ok {
+		fmt.Fprintf(sb, "hash: %v\n", v["hash"])
+	}
+}
+
+// writeExtracted writes a file under root with the entry's mode (or def if
+// unset).
+func writeExtracted(root, dst, text string, m map[string]any, def fs.FileMode) error {
+	if err := mkdirInside(root, filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := checkInside(root, dst); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst, []byte(text), 0600); err != nil {
+		return err
+	}
+	return chmodEntry(dst, m, def)
+}
+
+// chmodEntry applies the entry's mode exactly, bypassing the umask.
+func chmodEntry(dst string, m map[string]any, def fs.FileMode) error {
+	mode := def
+	if v, ok := m["mode"].(float64); ok {
+		mode = fs.FileMode(int(v)) & fs.ModePerm
+	}
+	return os.Chmod(dst, mode)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractIgnition(t *testing.T) {
+	doc := parseDoc(t, `{
+  "storage": {
+    "directories": [{"path": "/etc/quadsync", "mode": 448}],
+    "files": [
+      {"path": "/usr/local/bin/quadsync", "mode": 493,
+       "contents": {"source": "https://example.com/quadsync", "verification": {"hash": "sha256-aa"}}},
+      {"path": "/etc/quadsync/transforms/_base.container", "mode": 420,
+       "contents": {"compression": "gzip", "source": "`+gzipSource(t, "[Service]\nRestart=on-failure\n")+`"}},
+      {"path": "/etc/tailscale/oauth.env", "mode": 384,
+       "contents": {"source": "`+plainSource("TS_API_CLIENT_SECRET=s3cret\n")+`"}}
+    ],
+    "links": [{"path": "/etc/localtime", "target": "/usr/share/zoneinfo/UTC"}]
+  },
+  "systemd": {"units": [
+    {"name": "quadsync-sync.service", "contents": "[Service]\nType=oneshot\n",
+     "dropins": [{"name": "10-env.conf", "contents": "[Service]\nEnvironment=A=1\n"}]},
+    {"name": "debug.service", "mask": true}
+  ]}
+}`)
+	root := filepath.Join(t.TempDir(), "rendered")
+
+	n, err := extractIgnition(doc, root, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 7 {
+		t.Errorf("extracted %d entries, want 7", n)
+	}
+
+	read := func(rel string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(root, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	mode := func(rel string) os.FileMode {
+		t.Helper()
+		fi, err := os.Lstat(filepath.Join(root, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Mode().Perm()
+	}
+
+	if got := read("etc/quadsync/transforms/_base.container"); got != "[Service]\nRestart=on-failure\n" {
+		t.Errorf("_base.container = %q", got)
+	}
+	if got := mode("etc/quadsync/transforms/_base.container"); got != 0644 {
+		t.Errorf("_base.container mode = %o", got)
+	}
+	if got := mode("etc/quadsync"); got != 0700 {
+		t.Errorf("/etc/quadsync mode = %o, want 700", got)
+	}
+	if got := mode("etc/tailscale/oauth.env"); got != 0600 {
+		t.Errorf("oauth.env mode = %o, want 600", got)
+	}
+	if got := read("etc/tailscale/oauth.env"); !strings.Contains(got, "s3cret") {
+		t.Errorf("oauth.env should be extracted as-is without --redact, got %q", got)
+	}
+
+	stub := read("usr/local/bin/quadsync")
+	if !strings.Contains(stub, "source: https://example.com/quadsync\n") || !strings.Contains(stub, "hash: sha256-aa\n") {
+		t.Errorf("remote stub = %q", stub)
+	}
+
+	if got := read("etc/systemd/system/quadsync-sync.service"); got != "[Service]\nType=oneshot\n" {
+		t.Errorf("unit = %q", got)
+	}
+	if got := read("etc/systemd/system/quadsync-sync.service.d/10-env.conf"); !strings.Contains(got, "Environment=A=1") {
+		t.Errorf("dropin = %q", got)
+	}
+	// Absolute targets would point out of the tree, so they become stubs.
+	if got := read("etc/systemd/system/debug.service"); got != "# symlink to /dev/null\n" {
+		t.Errorf("masked unit = %q", got)
+	}
+	if got := read("etc/localtime"); got != "# symlink to /usr/share/zoneinfo/UTC\n" {
+		t.Errorf("link = %q", got)
+	}
+}
+
+func TestExtractIgnitionDirModesDeepestFirst(t *testing.T) {
+	// The parent comes last and loses its search permission, which would
+	// stop a non-root user changing the child after it.
+	doc := parseDoc(t, `{"storage": {"directories": [
+  {"path": "/etc/outer/inner", "mode": 448},
+  {"path": "/etc/outer", "mode": 384}]}}`)
+	root := filepath.Join(t.TempDir(), "rendered")
+	t.Cleanup(func() { os.Chmod(filepath.Join(root, "etc/outer"), 0755) })
+	if _, err := extractIgnition(doc, root, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outer := filepath.Join(root, "etc/outer")
+	if fi, err := os.Stat(outer); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("etc/outer: %v, %v, want mode 0600", fi, err)
+	}
+	os.Chmod(outer, 0755)
+	if fi, err := os.Stat(filepath.Join(outer, "inner")); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("etc/outer/inner: %v, %v, want mode 0700", fi, err)
+	}
+}
+
+func TestExtractIgnitionHostileLinks(t *testing.T) {
+	outside := t.TempDir()
+	doc := parseDoc(t, `{
+  "storage": {
+    "directories": [{"path": "/etc/locked", "mode": 365}],
+    "files": [{"path": "/etc/locked/motd", "mode": 420, "contents": {"source": "`+plainSource("hello")+`"}}],
+    "links": [
+      {"path": "/etc/escape", "target": "`+outside+`"},
+      {"path": "/etc/up", "target": "../../.."},
+      {"path": "/etc/sibling", "target": "locked/motd"}
+    ]
+  },
+  "systemd": {"units": [{"name": "app.service", "contents": "[Service]\n"}]}
+}`)
+	root := filepath.Join(t.TempDir(), "rendered")
+	if _, err := extractIgnition(doc, root, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("extract wrote %d entries outside the root", len(entries))
+	}
+	for rel, want := range map[string]string{
+		"etc/escape":      "# symlink to " + outside + "\n",
+		"etc/up":          "# symlink to ../../..\n",
+		"etc/sibling":     "hello",
+		"etc/locked/motd": "hello",
+	} {
+		if data, err := os.ReadFile(filepath.Join(root, rel)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", rel, data, err, want)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(root, "etc/locked")); err != nil || fi.Mode().Perm() != 0555 {
+		t.Errorf("read-only directory: %v, %v", fi, err)
+	}
+
+	// A link that already sits where a unit is written must not be followed.
+	root = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc/systemd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, unitDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeExtracted(root, filepath.Join(root, unitDir, "app.service"), "x", nil, 0644); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Errorf("writing through a symlink: error = %v", err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("write followed the symlink out of the root")
+	}
+}
+
+func TestExtractIgnitionRedact(t *testing.T) {
+	doc := parseDoc(t, `{"storage": {"files": [
+  {"path": "/etc/containers/auth.json", "mode": 420, "contents": {"source": "`+plainSource(`{"auths":{}}`)+`"}},
+  {"path": "/etc/quadsync/age.key", "mode": 384, "contents": {"source": "`+plainSource("AGE-SECRET-KEY-1")+`"}},
+  {"path": "/etc/motd", "mode": 420, "contents": {"source": "`+plainSource("hello")+`"}}
+]}}`)
+	root := t.TempDir()
+	if _, err := extractIgnition(doc, root, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, rel := range []string{"etc/containers/auth.json", "etc/quadsync/age.key"} {
+		data, err := os.ReadFile(filepath.Join(root, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != redactedContents {
+			t.Errorf("%s = %q, want redacted", rel, data)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "etc/motd")); string(data) != "hello" {
+		t.Errorf("non-secret file = %q", data)
+	}
+}
+
+func TestExtractIgnitionRejectsNonEmptyTarget(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "stale"), "x")
+	if _, err := extractIgnition(parseDoc(t, `{}`), root, false); err == nil {
+		t.Error("expected error for non-empty target")
+	}
+}
+
+func TestExtractPathStaysInsideRoot(t *testing.T) {
+	got, err := extractPath("/tmp/root", "/etc/../../escape")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "/tmp/root/escape" {
+		t.Errorf("got %q, want path kept inside root", got)
+	}
+	if _, err := extractPath("/tmp/root", "relative/path"); err == nil {
+		t.Error("expected error for relative path")
+	}
+}
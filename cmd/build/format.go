@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// formatChecks validate site.env values before anything is rendered, so a
+// value that would only fail on the VM fails the build instead. Each error
+// completes "VAR ...", saying what is wrong and how to fix it without
+// quoting the value, which may be a secret. List variables are checked item by item.
+var formatChecks = map[string]func(string) error{
+	"SSH_PUBKEY":               checkSSHKey,
+	"SSH_PUBKEYS":              checkSSHKey,
+	"SSH_AUTHORIZED_KEYS_FILE": checkSiteFile,
+	"QUADSYNC_GIT_URL":         checkGitSSHURL,
+	"QUADSYNC_GIT_BRANCH":      checkBranch,
+	"QUADSYNC_AGE_KEY":         checkAgeKey,
+	"TAILPOD_ARCH":             checkArch,
+	"OVERLAYS":                 checkOverlayName,
+	"TS_API_CLIENT_ID":         checkTailscaleClientID,
+	"TS_API_CLIENT_SECRET":     checkTailscaleClientSecret,
+	"TAILNET_DOMAIN":           checkTailnetDomain,
+	"REGISTRY_AUTH_B64":        checkRegistryAuth,
+	"STORAGE_SMB_HOST":         checkSMBHost,
+	"STORAGE_SMB_SHARE":        checkSMBShare,
+	"STORAGE_SMB_USER":         checkSingleLine,
+	"STORAGE_SMB_PASSWORD":     checkSingleLine,
+}
+
+// checkValues runs formatChecks over the variables that are set and reports
+// required ones that are empty. source names the file each value came from.
+func checkValues(vars, source map[string]string, allowed map[string]varType) error {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, k := range keys {
+		v := vars[k]
+		if v == "" {
+			if requiredVars[k] {
+				errs = append(errs, fmt.Errorf("%s: %s is empty; it is required for every build", source[k], k))
+			}
+			continue
+		}
+		check := formatChecks[k]
+		if check == nil {
+			continue
+		}
+		if typeOf(allowed, k) != typeList {
+			if err := check(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s %w", source[k], k, err))
+			}
+			continue
+		}
+		for i, item := range splitList(v) {
+			if err := check(item); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s item %d %w", source[k], k, i+1, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sshKeyTypes are the public key types OpenSSH accepts in authorized_keys.
+var sshKeyTypes = map[string]bool{
+	"ssh-ed25519":                        true,
+	"ssh-rsa":                            true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+func checkSSHKey(v string) error {
+	fields := strings.Fields(v)
+	if len(fields) < 2 || !sshKeyTypes[fields[0]] {
+		return errors.New(`is not an SSH public key; paste the whole line of your .pub file, e.g. "ssh-ed25519 AAAA... you@host" (ssh-keygen -y -f <private key> prints it)`)
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return fmt.Errorf("has %s key data that isn't valid base64, so it was probably cut off or wrapped when copied; paste the .pub line again", fields[0])
+	}
+	// The key data starts with its type as a length-prefixed string. The
+	// length stays a uint32: as an int it can be negative on 32-bit platforms.
+	if len(blob) < 4 || binary.BigEndian.Uint32(blob) > uint32(len(blob)-4) || string(blob[4:4+binary.BigEndian.Uint32(blob)]) != fields[0] {
+		return fmt.Errorf("has key data that doesn't hold a %s key; check that the type at the start of the line belongs to the key", fields[0])
+	}
+	return nil
+}
+
+func checkSiteFile(v string) error {
+	if filepath.IsAbs(v) || hasDotDot(v) {
+		return errors.New("must name a file in the site directory, relative to it, e.g. authorized_keys")
+	}
+	return nil
+}
+
+// hasDotDot reports whether path has a ".." element.
+func hasDotDot(path string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// scpLikeURL matches git's user@host:path form of SSH URL.
+var scpLikeURL = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^\s]+$`)
+
+func checkGitSSHURL(v string) error {
+	if scpLikeURL.MatchString(v) {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err == nil && u.Scheme == "ssh" && u.Host != "" && u.Path != "" {
+		return nil
+	}
+	if err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" {
+		// Don't echo the URL, which may carry a token.
+		return fmt.Errorf("is an %s URL, but quadsync clones over SSH with deploy_key; use git@%s:%s", strings.ToUpper(u.Scheme), u.Hostname(), strings.TrimPrefix(u.Path, "/"))
+	}
+	return errors.New("is not an SSH git URL; use the form git@github.com:your-org/containers.git or ssh://git@host/path")
+}
+
+func checkBranch(v string) error {
+	if strings.HasPrefix(v, "-") || strings.HasPrefix(v, "/") || strings.HasSuffix(v, "/") ||
+		strings.HasSuffix(v, ".") || strings.HasSuffix(v, ".lock") ||
+		strings.Contains(v, "..") || strings.Contains(v, "//") || strings.Contains(v, "@{") ||
+		strings.ContainsAny(v, " ~^:?*[\\") || strings.ContainsFunc(v, unicode.IsControl) {
+		return errors.New("is not a valid git branch name; use the branch name as git shows it, e.g. main")
+	}
+	return nil
+}
+
+// ageSecretKey matches an age X25519 identity: the bech32 encoding of the
+// key, upper-cased.
+var ageSecretKey = regexp.MustCompile(`^AGE-SECRET-KEY-1[QPZRY9X8GF2TVDW0S3JN54KHCE6MUA7L]+$`)
+
+func checkAgeKey(v string) error {
+	switch {
+	case strings.HasPrefix(v, "age1"):
+		return errors.New("is an age public key (a recipient); use the AGE-SECRET-KEY-1... line from the key file age-keygen wrote")
+	case !strings.HasPrefix(v, "AGE-SECRET-KEY-"):
+		return errors.New("doesn't start with AGE-SECRET-KEY-; use the AGE-SECRET-KEY-1... line from the key file age-keygen wrote, without the # comments")
+	case !ageSecretKey.MatchString(v):
+		return errors.New("has characters an age key can't contain; copy the AGE-SECRET-KEY-1... line again, in full")
+	}
+	return nil
+}
+
+func checkArch(v string) error {
+	if _, err := parseArchList(v); err != nil {
+		return fmt.Errorf("has an %w", err)
+	}
+	return nil
+}
+
+func checkOverlayName(v string) error {
+	if strings.ContainsAny(v, `/\`) {
+		return errors.New("names an overlay by path; use its file name without the directory, e.g. tailscale")
+	}
+	return nil
+}
+
+func checkTailscaleClientID(v string) error {
+	if strings.HasPrefix(v, "tskey-") {
+		return errors.New("looks like a Tailscale key rather than an OAuth client ID; the ID is the shorter value shown next to the client in the admin console, and the tskey-client-... secret goes in TS_API_CLIENT_SECRET")
+	}
+	if strings.ContainsFunc(v, unicode.IsSpace) {
+		return errors.New("contains whitespace; copy the OAuth client ID again")
+	}
+	return nil
+}
+
+func checkTailscaleClientSecret(v string) error {
+	switch {
+	case strings.HasPrefix(v, "tskey-auth-"):
+		return errors.New("is an auth key; tailmint needs an OAuth client secret (tskey-client-...), created under Settings > OAuth clients in the Tailscale admin console")
+	case strings.HasPrefix(v, "tskey-api-"):
+		return errors.New("is an API access token; tailmint needs an OAuth client secret (tskey-client-...), created under Settings > OAuth clients in the Tailscale admin console")
+	case !strings.HasPrefix(v, "tskey-client-"):
+		return errors.New("doesn't start with tskey-client-; use the secret of an OAuth client from Settings > OAuth clients in the Tailscale admin console")
+	}
+	return nil
+}
+
+// dnsName matches a host name: dot-separated labels of letters, digits and
+// inner hyphens.
+var dnsName = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+func checkTailnetDomain(v string) error {
+	if !strings.HasSuffix(v, ".ts.net") || !dnsName.MatchString(v) {
+		return errors.New("is not a tailnet DNS name; use the name from the DNS page of the Tailscale admin console, e.g. tail1234.ts.net, without https:// or a host name")
+	}
+	return nil
+}
+
+func checkRegistryAuth(v string) error {
+	const howto = "generate it with: printf '%s' 'user:token' | base64"
+	decoded, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return errors.New("isn't valid base64; " + howto)
+	}
+	if strings.ContainsAny(string(decoded), "\r\n") {
+		return errors.New("decodes to text with a line break, usually from encoding with echo; " + howto)
+	}
+	user, token, ok := strings.Cut(string(decoded), ":")
+	if !ok || user == "" || token == "" {
+		return errors.New("doesn't decode to user:token; " + howto)
+	}
+	return nil
+}
+
+func checkSMBHost(v string) error {
+	if strings.ContainsAny(v, `/\`) {
+		return errors.New("should be the host name only, e.g. your-storage-box.your-server.de; the share goes in STORAGE_SMB_SHARE")
+	}
+	if net.ParseIP(v) == nil && !dnsName.MatchString(v) {
+		return errors.New("is not a host name or IP address")
+	}
+	return nil
+}
+
+func checkSMBShare(v string) error {
+	if strings.ContainsAny(v, `/\`) || strings.ContainsFunc(v, unicode.IsControl) {
+		return errors.New("should be the share name only, e.g. backup, without slashes or the host")
+	}
+	return nil
+}
+
+func checkSingleLine(v string) error {
+	if strings.ContainsFunc(v, unicode.IsControl) {
+		return errors.New("has a line break or control character; the SMB credentials file holds one value per line")
+	}
+	return nil
+}
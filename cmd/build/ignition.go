@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// secretFilePaths are files whose contents are credentials even though their
+// mode doesn't say so (auth.json is world-readable so rootless podman can use it).
+var secretFilePaths = map[string]bool{
+	"/etc/containers/auth.json": true,
+}
+
+// loadIgnition reads and parses a generated Ignition config.
+func loadIgnition(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return doc, nil
+}
+
+// ignEntries returns the objects in doc[section][field], in order.
+func ignEntries(doc map[string]any, section, field string) []map[string]any {
+	sec, ok := doc[section].(map[string]any)
+	if !ok {
+		return nil
+	}
+	arr, _ := sec[field].([]any)
+	var entries []map[string]any
+	for _, item := range arr {
+		if m, ok := item.(map[string]any); ok {
+			entries = append(entries, m)
+		}
+	}
+	return entries
+}
+
+// ignIndex keys the entries of doc[section][field] by their string key field
+// (path or name). The returned keys are in document order.
+func ignIndex(doc map[string]any, section, field, key string) (map[string]map[string]any, []string) {
+	index := make(map[string]map[string]any)
+	var order []string
+	for _, m := range ignEntries(doc, section, field) {
+		k, _ := m[key].(string)
+		if k == "" {
+			continue
+		}
+		if _, dup := index[k]; !dup {
+			order = append(order, k)
+		}
+		index[k] = m
+	}
+	return index, order
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatMode renders an Ignition mode, which JSON carries as a decimal
+// number, in the octal form used in .bu files. It returns "" if unset.
+func formatMode(v any) string {
+	mode, ok := v.(float64)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%04o", int(mode))
+}
+
+// formatValue renders a field value for display. Modes are shown in octal.
+func formatValue(key string, v any) string {
+	if v == nil {
+		return "(unset)"
+	}
+	if key == "mode" {
+		if m := formatMode(v); m != "" {
+			return m
+		}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// isSecretFile reports whether a storage.files entry holds credentials and
+// must not have its contents printed: known credential paths, and anything
+// readable only by its owner (deploy-key, age.key, oauth.env, ...).
+func isSecretFile(entry map[string]any) bool {
+	path, _ := entry["path"].(string)
+	if secretFilePaths[path] {
+		return true
+	}
+	mode, ok := entry["mode"].(float64)
+	return ok && int(mode)&0o077 == 0
+}
+
+// remoteSource describes a file whose contents are fetched at first boot,
+// or returns "" for inline (data: URI) contents.
+func remoteSource(entry map[string]any) string {
+	contents, ok := entry["contents"].(map[string]any)
+	if !ok {
+		return ""
+	}
+	source, _ := contents["source"].(string)
+	if source == "" || strings.HasPrefix(source, "data:") {
+		return ""
+	}
+	if v, ok := contents["verification"].(map[string]any); ok {
+		if hash, _ := v["hash"].(string); hash != "" {
+			return source + " (" + hash + ")"
+		}
+	}
+	return source
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+)
+
+// transformsDir holds quadsync transforms. Same-path files under it are
+// merged section by section rather than concatenated as text.
+const transformsDir = "/etc/quadsync/transforms/"
+
+// multiValueKeys are systemd and Quadlet keys that may appear several times
+// in a section, each occurrence adding a value. Any other key is single-valued:
+// a later assignment replaces an earlier one.
+var multiValueKeys = map[string]bool{
+	// [Unit]
+	"After": true, "Before": true, "Requires": true, "Wants": true, "BindsTo": true,
+	"PartOf": true, "Requisite": true, "Conflicts": true, "Upholds": true,
+	"OnFailure": true, "OnSuccess": true, "Documentation": true,
+	// [Service]
+	"ExecStartPre": true, "ExecStartPost": true, "ExecCondition": true, "ExecReload": true,
+	"ExecStop": true, "ExecStopPost": true, "Environment": true, "EnvironmentFile": true,
+	// [Install]
+	"WantedBy": true, "RequiredBy": true, "UpheldBy": true, "Alias": true, "Also": true,
+	// [Container], [Pod], [Volume]
+	"Volume": true, "PodmanArgs": true, "GlobalArgs": true, "Label": true, "Annotation": true,
+	"AddCapability": true, "DropCapability": true, "AddDevice": true, "AddHost": true,
+	"PublishPort": true, "ExposeHostPort": true, "Network": true, "Mount": true, "Tmpfs": true,
+	"Secret": true, "DNS": true, "DNSSearch": true, "DNSOption": true, "Sysctl": true,
+	"Mask": true, "Unmask": true, "Ulimit": true, "UIDMap": true, "GIDMap": true,
+	"GroupAdd": true, "Options": true,
+}
+
+// iniFile is a parsed Quadlet/systemd unit file that remembers which part
+// contributed each line.
+type iniFile struct {
+	preamble []string // comment lines before the first section
+	sections []*iniSection
+}
+
+type iniSection struct {
+	name  string
+	lines []iniLine
+}
+
+// iniLine is a comment or a Key=Value assignment. Prepend entries keep their
+// "+" in key, since quadsync treats +Key and Key differently.
+type iniLine struct {
+	raw   string
+	key   string // "" for comments
+	value string
+	owner string
+}
+
+// parseINI parses a unit file. Blank lines are dropped; render puts one
+// between sections. An assignment ending in a backslash continues on the
+// next line, as in systemd: its lines are kept together in raw, and value
+// joins them with spaces. Comment lines within it are kept in raw only.
+func parseINI(text, owner string) *iniFile {
+	f := &iniFile{}
+	var cur *iniSection
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			cur = f.section(line[1 : len(line)-1])
+			continue
+		}
+		l := iniLine{raw: line, owner: owner}
+		if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, ";") {
+			for strings.HasSuffix(line, `\`) && i+1 < len(lines) {
+				i++
+				l.raw += "\n" + strings.TrimRight(lines[i], " \t")
+				next := strings.TrimSpace(lines[i])
+				if strings.HasPrefix(next, "#") || strings.HasPrefix(next, ";") {
+					continue
+				}
+				line = strings.TrimSpace(strings.TrimSuffix(line, `\`)) + " " + next
+			}
+			if k, v, ok := strings.Cut(line, "="); ok {
+				l.key, l.value = strings.TrimSpace(k), strings.TrimSpace(v)
+			}
+		}
+		if cur == nil {
+			f.preamble = append(f.preamble, l.raw)
+			continue
+		}
+		cur.lines = append(cur.lines, l)
+	}
+	return f
+}
+
+// section returns the named section, appending it if it doesn't exist yet.
+func (f *iniFile) section(name string) *iniSection {
+	for _, s := range f.sections {
+		if s.name == name {
+			return s
+		}
+	}
+	s := &iniSection{name: name}
+	f.sections = append(f.sections, s)
+	return s
+}
+
+// merge adds other's sections to f in order. Prepend (+Key) and multi-value
+// entries accumulate in part order; a single-valued key set again with a
+// different value replaces the earlier one, and a warning naming both parts
+// is returned.
+func (f *iniFile) merge(other *iniFile) []string {
+	var warnings []string
+	f.preamble = append(f.preamble, other.preamble...)
+	for _, src := range other.sections {
+		s := f.section(src.name)
+	lines:
+		for _, l := range src.lines {
+			if l.key == "" || strings.HasPrefix(l.key, "+") || multiValueKeys[l.key] {
+				s.lines = append(s.lines, l)
+				continue
+			}
+			for i, prev := range s.lines {
+				if prev.key != l.key {
+					continue
+				}
+				if prev.value != l.value {
+					warnings = append(warnings, "["+s.name+"] "+l.key+"="+l.value+" ("+l.owner+") overrides "+prev.key+"="+prev.value+" ("+prev.owner+")")
+					s.lines[i] = l
+				}
+				continue lines
+			}
+			s.lines = append(s.lines, l)
+		}
+	}
+	return warnings
+}
+
+// render formats the file with a blank line between sections.
+func (f *iniFile) render() string {
+	var sb strings.Builder
+	for _, l := range f.preamble {
+		sb.WriteString(l + "\n")
+	}
+	for i, s := range f.sections {
+		if i > 0 || len(f.preamble) > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString("[" + s.name + "]\n")
+		for _, l := range s.lines {
+			sb.WriteString(l.raw + "\n")
+		}
+	}
+	return sb.String()
+}
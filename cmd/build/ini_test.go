@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestINIMergeCombinesSections(t *testing.T) {
+	base := parseINI(`[Service]
+Restart=on-failure
+RestartSec=10s
+
+[Install]
+WantedBy=default.target
+`, "tailpod.bu")
+	overlay := parseINI(`[Unit]
+After=var-mnt-storage.mount
+Requires=var-mnt-storage.mount
+
+[Service]
++ExecStartPre=sudo /usr/local/bin/storage-init %N
+Restart=on-failure
+
+[Container]
++Volume={{.Name}}-data.volume:/data
+`, "server.bu")
+
+	if w := base.merge(overlay); len(w) != 0 {
+		t.Errorf("unexpected warnings: %v", w)
+	}
+	want := `[Service]
+Restart=on-failure
+RestartSec=10s
++ExecStartPre=sudo /usr/local/bin/storage-init %N
+
+[Install]
+WantedBy=default.target
+
+[Unit]
+After=var-mnt-storage.mount
+Requires=var-mnt-storage.mount
+
+[Container]
++Volume={{.Name}}-data.volume:/data
+`
+	if got := base.render(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestINIMergeKeepsPrependOrder(t *testing.T) {
+	f := parseINI("[Service]\n+ExecStartPre=a\n", "tailpod.bu")
+	f.merge(parseINI("[Service]\n+ExecStartPre=b\nExecStartPre=c\n", "tailscale.bu"))
+	f.merge(parseINI("[Service]\n+ExecStartPre=d\nExecStartPre=c\n", "server.bu"))
+
+	want := "[Service]\n+ExecStartPre=a\n+ExecStartPre=b\nExecStartPre=c\n+ExecStartPre=d\nExecStartPre=c\n"
+	if got := f.render(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestINIMergeWarnsOnSingleValueConflict(t *testing.T) {
+	f := parseINI("[Service]\nRestart=on-failure\n", "tailpod.bu")
+	warnings := f.merge(parseINI("[Service]\nRestart=always\n", "tailscale.bu"))
+
+	if len(warnings) != 1 {
+		t.Fatalf("got %d warnings, want 1: %v", len(warnings), warnings)
+	}
+	want := "[Service] Restart=always (tailscale.bu) overrides Restart=on-failure (tailpod.bu)"
+	if warnings[0] != want {
+		t.Errorf("warning = %q, want %q", warnings[0], want)
+	}
+	if got := f.render(); got != "[Service]\nRestart=always\n" {
+		t.Errorf("later value should win, got:\n%s", got)
+	}
+}
+
+func TestINIContinuationLines(t *testing.T) {
+	f := parseINI(`[Service]
+ExecStart=/usr/bin/podman run \
+  --name web \
+# a comment inside the value
+  Restart=always
+Restart=on-failure
+`, "tailpod.bu")
+	lines := f.sections[0].lines
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %+v", len(lines), lines)
+	}
+	if got, want := lines[0].value, "/usr/bin/podman run --name web Restart=always"; lines[0].key != "ExecStart" || got != want {
+		t.Errorf("ExecStart = %q, want %q", got, want)
+	}
+
+	warnings := f.merge(parseINI("[Service]\nExecStart=/usr/bin/podman run \\\n  --name web Restart=always\nRestart=always\n", "server.bu"))
+	want := "[Service] Restart=always (server.bu) overrides Restart=on-failure (tailpod.bu)"
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("warnings = %q, want only %q", warnings, want)
+	}
+	wantText := `[Service]
+ExecStart=/usr/bin/podman run \
+  --name web \
+# a comment inside the value
+  Restart=always
+Restart=always
+`
+	if got := f.render(); got != wantText {
+		t.Errorf("got:\n%s\nwant:\n%s", got, wantText)
+	}
+
+	// Before the first section too.
+	preamble := "# transform\nKey=a \\\n  b\n\n[Service]\nRestart=always\n"
+	if got := parseINI(preamble, "tailpod.bu").render(); got != preamble {
+		t.Errorf("preamble: got:\n%s\nwant:\n%s", got, preamble)
+	}
+}
+
+func TestMergePartsTransformsAreINIMerged(t *testing.T) {
+	const path = "/etc/quadsync/transforms/_base.container"
+	first := `{"path": "` + path + `", "mode": 420, "contents": {"source": "` + plainSource("[Service]\nRestart=on-failure\n") + `"}}`
+	second := `{"path": "` + path + `", "mode": 420, "contents": {"source": "` + plainSource("[Service]\n+ExecStartPre=x\nRestart=always\n") + `"}}`
+	third := `{"path": "` + path + `", "mode": 420, "contents": {"source": "` + plainSource("[Service]\n+ExecStartPre=y\n") + `"}}`
+
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"storage": {"files": [` + first + `]}}`)},
+		{name: "tailscale.bu", ign: []byte(`{"storage": {"files": [` + second + `]}}`)},
+		{name: "server.bu", ign: []byte(`{"storage": {"files": [` + third + `]}}`)},
+	}
+	m, err := mergeParts(parts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := decodeDataURI(ignEntries(m.doc, "storage", "files")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[Service]\nRestart=always\n+ExecStartPre=x\n+ExecStartPre=y\n"; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if len(m.warnings) != 1 || !strings.Contains(m.warnings[0], "Restart=always (tailscale.bu) overrides Restart=on-failure (tailpod.bu)") {
+		t.Errorf("warnings = %v", m.warnings)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runInspect implements `tailpod inspect [--cat PATH] tailpod.ign`.
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("tailpod inspect", flag.ContinueOnError)
+	catPath := fs.String("cat", "", "print the decoded contents of one storage.files `path`")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: tailpod inspect [--cat PATH] FILE.ign")
+	}
+	doc, err := loadIgnition(positional[0])
+	if err != nil {
+		return err
+	}
+	if *catPath != "" {
+		text, err := catFile(doc, *catPath)
+		if err != nil {
+			return err
+		}
+		fmt.Print(text)
+		return nil
+	}
+	writeInspect(os.Stdout, doc)
+	return nil
+}
+
+// parseInterspersed parses flags that may appear before or after positional
+// arguments (`inspect tailpod.ign --cat /etc/x`), which flag.Parse alone stops at.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// catFile returns the decoded contents of the storage.files entry at path.
+func catFile(doc map[string]any, path string) (string, error) {
+	files, _ := ignIndex(doc, "storage", "files", "path")
+	entry, ok := files[path]
+	if !ok {
+		return "", fmt.Errorf("%s: not in storage.files", path)
+	}
+	if r := remoteSource(entry); r != "" {
+		return "", fmt.Errorf("%s: fetched at first boot from %s", path, r)
+	}
+	text, err := decodeDataURI(entry)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return text, nil
+}
+
+// writeInspect prints every storage, systemd and passwd entry with its mode
+// and a short description of its contents.
+func writeInspect(w io.Writer, doc map[string]any) {
+	if ign, ok := doc["ignition"].(map[string]any); ok {
+		fmt.Fprintf(w, "ignition %v\n", ign["version"])
+	}
+
+	writeInspectSection(w, doc, "storage", "directories", "path", func(m map[string]any) string {
+		return ownerSuffix(m)
+	})
+	writeInspectSection(w, doc, "storage", "files", "path", func(m map[string]any) string {
+		if r := remoteSource(m); r != "" {
+			return ownerSuffix(m) + "  <- " + r
+		}
+		text, err := decodeDataURI(m)
+		if err != nil {
+			return ownerSuffix(m) + "  (" + err.Error() + ")"
+		}
+		desc := fmt.Sprintf("%s  (%d bytes", ownerSuffix(m), len(text))
+		if c, _ := m["contents"].(map[string]any); c != nil && c["compression"] == "gzip" {
+			desc += ", gzip"
+		}
+		if m["append"] != nil {
+			desc += ", append"
+		}
+		return desc + ")"
+	})
+	writeInspectSection(w, doc, "storage", "links", "path", func(m map[string]any) string {
+		desc := fmt.Sprintf(" -> %v", m["target"])
+		if hard, _ := m["hard"].(bool); hard {
+			desc += " (hard)"
+		}
+		return desc + ownerSuffix(m)
+	})
+	writeInspectSection(w, doc, "systemd", "units", "name", func(m map[string]any) string {
+		var attrs []string
+		if enabled, ok := m["enabled"].(bool); ok {
+			if enabled {
+				attrs = append(attrs, "enabled")
+			} else {
+				attrs = append(attrs, "disabled")
+			}
+		}
+		if mask, _ := m["mask"].(bool); mask {
+			attrs = append(attrs, "masked")
+		}
+		for _, d := range asSlice(m["dropins"]) {
+			if dm, ok := d.(map[string]any); ok {
+				attrs = append(attrs, fmt.Sprintf("dropin %v", dm["name"]))
+			}
+		}
+		if len(attrs) == 0 {
+			return ""
+		}
+		return "  (" + strings.Join(attrs, ", ") + ")"
+	})
+	writeInspectSection(w, doc, "passwd", "users", "name", func(m map[string]any) string {
+		var attrs []string
+		if keys := asSlice(m["sshAuthorizedKeys"]); len(keys) > 0 {
+			attrs = append(attrs, fmt.Sprintf("%d ssh keys", len(keys)))
+		}
+		if groups := asSlice(m["groups"]); len(groups) > 0 {
+			var names []string
+			for _, g := range groups {
+				names = append(names, fmt.Sprint(g))
+			}
+			attrs = append(attrs, "groups "+strings.Join(names, ","))
+		}
+		for _, k := range []string{"uid", "homeDir", "shell"} {
+			if v, ok := m[k]; ok {
+				attrs = append(attrs, fmt.Sprintf("%s %v", k, v))
+			}
+		}
+		if len(attrs) == 0 {
+			return ""
+		}
+		return "  (" + strings.Join(attrs, ", ") + ")"
+	})
+	writeInspectSection(w, doc, "passwd", "groups", "name", func(m map[string]any) string {
+		if gid, ok := m["gid"]; ok {
+			return fmt.Sprintf("  (gid %v)", gid)
+		}
+		return ""
+	})
+}
+
+// writeInspectSection prints one section's entries sorted by key, each with
+// its mode (or blanks) in the first column.
+func writeInspectSection(w io.Writer, doc map[string]any, section, field, key string, describe func(map[string]any) string) {
+	index, order := ignIndex(doc, section, field, key)
+	if len(order) == 0 {
+		return
+	}
+	sort.Strings(order)
+	fmt.Fprintf(w, "%s.%s\n", section, field)
+	for _, k := range order {
+		m := index[k]
+		mode := formatMode(m["mode"])
+		if mode == "" {
+			mode = "    "
+		}
+		if section == "storage" {
+			fmt.Fprintf(w, "  %s %s%s\n", mode, k, describe(m))
+		} else {
+			fmt.Fprintf(w, "  %s%s\n", k, describe(m))
+		}
+	}
+}
+
+// ownerSuffix describes non-default ownership of a storage entry.
+func ownerSuffix(m map[string]any) string {
+	var parts []string
+	for _, k := range []string{"user", "group"} {
+		if id, ok := m[k].(map[string]any); ok {
+			if name, ok := id["name"]; ok {
+				parts = append(parts, fmt.Sprintf("%s=%v", k, name))
+			} else if n, ok := id["id"]; ok {
+				parts = append(parts, fmt.Sprintf("%s=%v", k, n))
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "  [" + strings.Join(parts, " ") + "]"
+}
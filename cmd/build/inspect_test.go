@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func inspectDoc(t *testing.T) map[string]any {
+	t.Helper()
+	return parseDoc(t, `{
+  "ignition": {"version": "3.5.0"},
+  "storage": {
+    "directories": [{"path": "/etc/quadsync"}],
+    "files": [
+      {"path": "/usr/local/bin/quadsync", "mode": 493,
+       "contents": {"source": "https://example.com/quadsync", "verification": {"hash": "sha256-aa"}}},
+      {"path": "/etc/quadsync/transforms/_base.container", "mode": 420,
+       "contents": {"compression": "gzip", "source": "`+gzipSource(t, "[Service]\nRestart=on-failure\n")+`"}},
+      {"path": "/etc/tailpod/build", "mode": 420, "contents": {"source": "`+plainSource("abc123")+`"}}
+    ],
+    "links": [{"path": "/etc/localtime", "target": "/usr/share/zoneinfo/UTC"}]
+  },
+  "systemd": {"units": [
+    {"name": "quadsync-sync.timer", "enabled": true},
+    {"name": "quadsync-sync.service", "dropins": [{"name": "10-env.conf"}]}
+  ]},
+  "passwd": {
+    "users": [{"name": "core", "sshAuthorizedKeys": ["k1", "k2"], "groups": ["wheel"]}],
+    "groups": [{"name": "cusers"}]
+  }
+}`)
+}
+
+func TestWriteInspect(t *testing.T) {
+	var buf bytes.Buffer
+	writeInspect(&buf, inspectDoc(t))
+	got := buf.String()
+	for _, want := range []string{
+		"ignition 3.5.0\n",
+		"storage.directories\n       /etc/quadsync\n",
+		"  0755 /usr/local/bin/quadsync  <- https://example.com/quadsync (sha256-aa)\n",
+		"  0644 /etc/quadsync/transforms/_base.container  (29 bytes, gzip)\n",
+		"  0644 /etc/tailpod/build  (6 bytes)\n",
+		"       /etc/localtime -> /usr/share/zoneinfo/UTC\n",
+		"  quadsync-sync.timer  (enabled)\n",
+		"  quadsync-sync.service  (dropin 10-env.conf)\n",
+		"  core  (2 ssh keys, groups wheel)\n",
+		"passwd.groups\n  cusers\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestCatFile(t *testing.T) {
+	doc := inspectDoc(t)
+
+	got, err := catFile(doc, "/etc/quadsync/transforms/_base.container")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "[Service]\nRestart=on-failure\n" {
+		t.Errorf("gzip contents = %q", got)
+	}
+
+	got, err = catFile(doc, "/etc/tailpod/build")
+	if err != nil || got != "abc123" {
+		t.Errorf("plain contents = %q, %v", got, err)
+	}
+
+	if _, err := catFile(doc, "/usr/local/bin/quadsync"); err == nil || !strings.Contains(err.Error(), "fetched at first boot") {
+		t.Errorf("expected remote source error, got %v", err)
+	}
+	if _, err := catFile(doc, "/etc/missing"); err == nil {
+		t.Error("expected error for missing path")
+	}
+}
+
+func TestParseInterspersed(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cat := fs.String("cat", "", "")
+	positional, err := parseInterspersed(fs, []string{"tailpod.ign", "--cat", "/etc/x"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(positional, []string{"tailpod.ign"}) || *cat != "/etc/x" {
+		t.Errorf("positional = %v, cat = %q", positional, *cat)
+	}
+}
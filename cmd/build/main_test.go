@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"strings"
 	"testing"
 )
@@ -37,7 +36,7 @@ STORAGE_SMB_PASSWORD=password
 }
 
 func TestParseEnvValid(t *testing.T) {
-	vars, err := parseEnv(validEnv())
+	vars, err := parseEnv(validEnv(), testAllowed(t))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -50,7 +49,7 @@ func TestParseEnvValid(t *testing.T) {
 }
 
 func TestParseEnvWithTailscaleVars(t *testing.T) {
-	vars, err := parseEnv(validEnvWithTailscale())
+	vars, err := parseEnv(validEnvWithTailscale(), testAllowed(t))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -63,7 +62,7 @@ func TestParseEnvWithTailscaleVars(t *testing.T) {
 }
 
 func TestParseEnvWithStorageVars(t *testing.T) {
-	vars, err := parseEnv(validEnvWithStorage())
+	vars, err := parseEnv(validEnvWithStorage(), testAllowed(t))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -76,7 +75,7 @@ func TestParseEnvWithStorageVars(t *testing.T) {
 }
 
 func TestParseEnvWithAllVars(t *testing.T) {
-	vars, err := parseEnv(validEnvFull())
+	vars, err := parseEnv(validEnvFull(), testAllowed(t))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -93,7 +92,7 @@ SSH_PUBKEY=key
 QUADSYNC_GIT_URL=url
 QUADSYNC_GIT_BRANCH=main
 `
-	vars, err := parseEnv(input)
+	vars, err := parseEnv(input, testAllowed(t))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -115,9 +114,19 @@ func TestParseEnvRejectsMalformedLines(t *testing.T) {
 		},
 		{
 			name:  "shell command",
-			input: "export FOO=bar",
+			input: "rm -rf /tmp/tailpod",
+			want:  "not a KEY=VALUE",
+		},
+		{
+			name:  "invalid key",
+			input: "SSH-PUBKEY=key",
 			want:  "invalid character",
 		},
+		{
+			name:  "exported unknown variable",
+			input: "export FOO=bar",
+			want:  `unknown variable "FOO"`,
+		},
 		{
 			name:  "function definition",
 			input: "my_func() { echo hi; }",
@@ -131,7 +140,7 @@ func TestParseEnvRejectsMalformedLines(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := parseEnv(tt.input)
+			_, err := parseEnv(tt.input, testAllowed(t))
 			if err == nil {
 				t.Fatal("expected error, got nil")
 			}
@@ -197,100 +206,12 @@ func TestSubstituteMultipleOccurrences(t *testing.T) {
 	}
 }
 
-func TestMergeIgnitionFiles(t *testing.T) {
-	base := `{
-  "ignition": {"version": "3.4.0"},
-  "storage": {
-    "files": [{"path": "/etc/base"}],
-    "directories": [{"path": "/var/base"}]
-  },
-  "passwd": {
-    "users": [{"name": "core", "sshAuthorizedKeys": ["key1"]}]
-  },
-  "systemd": {
-    "units": [{"name": "base.service", "enabled": true}]
-  }
-}`
-
-	server := `{
-  "ignition": {"version": "3.4.0"},
-  "storage": {
-    "files": [{"path": "/etc/server"}]
-  },
-  "passwd": {
-    "users": [{"name": "core", "groups": ["docker"]}]
-  },
-  "systemd": {
-    "units": [{"name": "server.service", "enabled": true}]
-  }
-}`
-
-	merged, err := mergeIgnition([]byte(base), []byte(server))
-	if err != nil {
-		t.Fatalf("merge error: %v", err)
-	}
-
-	var result map[string]any
-	if err := json.Unmarshal(merged, &result); err != nil {
-		t.Fatalf("unmarshal merged: %v", err)
-	}
-
-	// Check files were concatenated
-	storage := result["storage"].(map[string]any)
-	files := storage["files"].([]any)
-	if len(files) != 2 {
-		t.Errorf("got %d files, want 2", len(files))
-	}
-
-	// Check users were merged by name
-	passwd := result["passwd"].(map[string]any)
-	users := passwd["users"].([]any)
-	if len(users) != 1 {
-		t.Errorf("got %d users, want 1 (merged by name)", len(users))
-	}
-	coreUser := users[0].(map[string]any)
-	if _, ok := coreUser["sshAuthorizedKeys"]; !ok {
-		t.Error("merged user missing sshAuthorizedKeys from base")
-	}
-	if _, ok := coreUser["groups"]; !ok {
-		t.Error("merged user missing groups from server")
-	}
-
-	// Check units were merged
-	systemd := result["systemd"].(map[string]any)
-	units := systemd["units"].([]any)
-	if len(units) != 2 {
-		t.Errorf("got %d units, want 2", len(units))
-	}
-}
-
-func TestMergeIgnitionEmptyServer(t *testing.T) {
-	base := `{"ignition": {"version": "3.4.0"}, "storage": {"files": [{"path": "/etc/base"}]}}`
-	server := `{"ignition": {"version": "3.4.0"}}`
-
-	merged, err := mergeIgnition([]byte(base), []byte(server))
-	if err != nil {
-		t.Fatalf("merge error: %v", err)
-	}
-
-	var result map[string]any
-	if err := json.Unmarshal(merged, &result); err != nil {
-		t.Fatalf("unmarshal: %v", err)
-	}
-
-	storage := result["storage"].(map[string]any)
-	files := storage["files"].([]any)
-	if len(files) != 1 {
-		t.Errorf("got %d files, want 1", len(files))
-	}
-}
-
 func TestParseEnvStripsSingleQuotes(t *testing.T) {
 	input := `SSH_PUBKEY='ssh-ed25519 AAAA'
 QUADSYNC_GIT_URL=url
 QUADSYNC_GIT_BRANCH=main
 `
-	vars, err := parseEnv(input)
+	vars, err := parseEnv(input, testAllowed(t))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -303,7 +224,7 @@ func TestParseEnvMissingRequired(t *testing.T) {
 	// Only one variable — should fail validation in run(), but parseEnv itself just parses what's given.
 	// This test verifies parseEnv accepts a subset (validation is in run()).
 	input := "SSH_PUBKEY=key\n"
-	vars, err := parseEnv(input)
+	vars, err := parseEnv(input, testAllowed(t))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ignPart is one rendered .bu file awaiting merge: tailpod.bu or an overlay.
+type ignPart struct {
+	name     string
+	ign      []byte
+	policies map[string]string // storage.files path -> merge policy
+}
+
+// mergeParts merges rendered parts in order into the first one.
+// Same-path storage.files are combined according to the merge policy either
+// part declares for that path (see mergeFiles); by default their inline
+// contents are appended. Directories and links are merged by path: identical
+// entries collapse into one, and conflicting ones are an error naming both parts.
+// Units are merged by name field by field, with drop-ins merged by drop-in
+// name; differing enabled, mask or contents values are errors.
+// Users are merged by name with sshAuthorizedKeys and groups unioned;
+// other user and group fields conflict if set differently. The remaining
+// sections are merged by their key (see mergePart).
+func mergeParts(parts []ignPart) (*merger, error) {
+	docs := make([]map[string]any, len(parts))
+	for i, p := range parts {
+		if err := json.Unmarshal(p.ign, &docs[i]); err != nil {
+			return nil, fmt.Errorf("parsing %s ignition: %w", p.name, err)
+		}
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("nothing to merge")
+	}
+
+	m := &merger{doc: make(map[string]any), owner: make(map[string]string), ini: make(map[string]*iniFile), policies: make(map[string]declaredPolicy), sources: make(provenance)}
+	var errs []error
+	for i, p := range parts {
+		errs = append(errs, m.mergePart(p, docs[i])...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// mergeSections lists the fields of each Ignition 3.x section mergePart
+// handles. Anything else is an error, so nothing an overlay declares is
+// silently dropped.
+var mergeSections = map[string][]string{
+	"ignition":        {"version", "config", "timeouts", "security", "proxy"},
+	"storage":         {"disks", "raid", "filesystems", "luks", "files", "directories", "links"},
+	"systemd":         {"units"},
+	"passwd":          {"users", "groups"},
+	"kernelArguments": {"shouldExist", "shouldNotExist"},
+}
+
+// mergePart merges one rendered part into the document. Disks and
+// filesystems are keyed by device, raid arrays and LUKS volumes by name;
+// kernel arguments and the lists in the ignition block (config.merge,
+// proxy.noProxy, security.tls.certificateAuthorities) are unioned, and every
+// other field conflicts if two parts set it differently.
+func (m *merger) mergePart(p ignPart, doc map[string]any) []error {
+	var errs []error
+	for _, section := range sortedKeys(doc) {
+		fields, known := mergeSections[section]
+		if !known {
+			errs = append(errs, fmt.Errorf("%s: %s is not supported by the merge", p.name, section))
+			continue
+		}
+		sec, _ := doc[section].(map[string]any)
+		errs = append(errs, unsupportedFields(p.name, section, sec, fields...)...)
+	}
+
+	errs = append(errs, m.mergeIgnitionBlock(p.name, asMap(doc["ignition"]))...)
+	errs = append(errs, m.mergeDevices(p.name, "disks", ignEntries(doc, "storage", "disks"))...)
+	errs = append(errs, m.mergeByKey(p.name, "storage", "raid", "name", ignEntries(doc, "storage", "raid"), m.fieldMerger(p.name))...)
+	errs = append(errs, m.mergeByKey(p.name, "storage", "luks", "name", ignEntries(doc, "storage", "luks"), m.fieldMerger(p.name))...)
+	errs = append(errs, m.mergeDevices(p.name, "filesystems", ignEntries(doc, "storage", "filesystems"))...)
+	errs = append(errs, m.mergeFiles(p, ignEntries(doc, "storage", "files"))...)
+	errs = append(errs, m.mergeByPath(p.name, "storage", "directories", ignEntries(doc, "storage", "directories"))...)
+	errs = append(errs, m.mergeByPath(p.name, "storage", "links", ignEntries(doc, "storage", "links"))...)
+	errs = append(errs, m.mergeUnits(p.name, ignEntries(doc, "systemd", "units"))...)
+	errs = append(errs, m.mergeUsers(p.name, ignEntries(doc, "passwd", "users"))...)
+	errs = append(errs, m.mergeGroups(p.name, ignEntries(doc, "passwd", "groups"))...)
+	errs = append(errs, m.mergeKernelArguments(p.name, asMap(doc["kernelArguments"]))...)
+	return errs
+}
+
+// unsupportedFields reports the fields of obj not listed in known.
+func unsupportedFields(name, key string, obj map[string]any, known ...string) []error {
+	var errs []error
+	for _, k := range sortedKeys(obj) {
+		if !slices.Contains(known, k) {
+			errs = append(errs, fmt.Errorf("%s: %s.%s is not supported by the merge", name, key, k))
+		}
+	}
+	return errs
+}
+
+// asMap returns v as a JSON object, or nil.
+func asMap(v any) map[string]any {
+	m, _ := v.(map[string]any)
+	return m
+}
+
+// merger accumulates parts into doc, remembering which part set each field
+// of a path-keyed entry so conflicts can name both sides.
+type merger struct {
+	doc      map[string]any
+	owner    map[string]string         // entryKey + "." + field -> part name
+	ini      map[string]*iniFile       // transforms merged so far, by path
+	policies map[string]declaredPolicy // storage.files path -> first declared merge policy
+	warnings []string                  // fallbacks the build should report
+	sources  provenance                // parts behind each entry, for --explain
+}
+
+func (m *merger) warnf(format string, args ...any) {
+	m.warnings = append(m.warnings, fmt.Sprintf(format, args...))
+}
+
+// object returns parent[field] as an object, creating it if needed.
+func object(parent map[string]any, field string) map[string]any {
+	obj, ok := parent[field].(map[string]any)
+	if !ok {
+		obj = make(map[string]any)
+		parent[field] = obj
+	}
+	return obj
+}
+
+// keyIndex returns doc[section][field] (creating the section if needed)
+// and the position of each entry in it by its key field (path or name).
+func (m *merger) keyIndex(section, field, key string) (map[string]any, []any, map[string]int) {
+	sec := object(m.doc, section)
+	arr, _ := sec[field].([]any)
+	index := make(map[string]int)
+	for i, item := range arr {
+		if e, ok := item.(map[string]any); ok {
+			if k, _ := e[key].(string); k != "" {
+				index[k] = i
+			}
+		}
+	}
+	return sec, arr, index
+}
+
+// mergeByPath adds entries to doc[section][field], collapsing entries whose
+// path is already present (see mergeFields).
+func (m *merger) mergeByPath(name, section, field string, entries []map[string]any) []error {
+	return m.mergeByKey(name, section, field, "path", entries, m.fieldMerger(name))
+}
+
+// own records name as the part that set every field of a new entry.
+func (m *merger) own(key, name string, e map[string]any) {
+	for k := range e {
+		m.owner[key+"."+k] = name
+	}
+}
+
+// mergeFields copies fields from incoming into existing. Fields set on only
+// one side are kept; fields set differently on both sides (mode, user, group,
+// target, ...) are conflicts. Fields listed in skip are left alone.
+func (m *merger) mergeFields(key, name string, existing, incoming map[string]any, skip ...string) []error {
+	var errs []error
+	for _, k := range sortedKeys(incoming) {
+		if slices.Contains(skip, k) {
+			continue
+		}
+		v := incoming[k]
+		prev, set := existing[k]
+		if !set {
+			existing[k] = v
+			m.owner[key+"."+k] = name
+			continue
+		}
+		a, b := formatValue(k, prev), formatValue(k, v)
+		switch {
+		case a == b:
+		case quietFields[k] || len(a) > maxQuoted || len(b) > maxQuoted:
+			errs = append(errs, fmt.Errorf("%s: %s from %s conflicts with the one from %s", key, k, m.owner[key+"."+k], name))
+		default:
+			errs = append(errs, fmt.Errorf("%s: %s %s (%s) conflicts with %s (%s)", key, k, a, m.owner[key+"."+k], b, name))
+		}
+	}
+	return errs
+}
+
+// quietFields are the fields whose values a conflict error doesn't quote:
+// file and unit bodies, which may hold substituted secrets, and password
+// hashes. Values longer than maxQuoted aren't quoted either.
+var quietFields = map[string]bool{"contents": true, "passwordHash": true}
+
+const maxQuoted = 80
+
+// mergeByKey adds entries to doc[section][field] keyed by their key field
+// (path, name or device). A new entry is merged into an empty one, so the
+// owner of every field is recorded; an entry whose key is already present is
+// combined with it by merge.
+func (m *merger) mergeByKey(name, section, field, key string, entries []map[string]any, merge entryMerger) []error {
+	if len(entries) == 0 {
+		return nil
+	}
+	sec, arr, index := m.keyIndex(section, field, key)
+
+	var errs []error
+	for _, e := range entries {
+		k, _ := e[key].(string)
+		if k == "" {
+			arr = append(arr, e)
+			continue
+		}
+		key := entryKey(section, field, k)
+		i, exists := index[k]
+		if exists {
+			m.sources.add(key, name, explainGrouped)
+		} else {
+			i = len(arr)
+			index[k] = i
+			arr = append(arr, make(map[string]any))
+			m.sources.add(key, name, "")
+		}
+		errs = append(errs, merge(key, arr[i].(map[string]any), e)...)
+	}
+	sec[field] = arr
+	return errs
+}
+
+// entryMerger combines incoming into the existing entry identified by key.
+type entryMerger func(key string, existing, incoming map[string]any) []error
+
+// fieldMerger merges entries field by field, unioning the listed fields.
+func (m *merger) fieldMerger(name string, lists ...string) entryMerger {
+	return func(key string, existing, incoming map[string]any) []error {
+		return m.mergeObject(key, name, existing, incoming, lists...)
+	}
+}
+
+// mergeObject merges incoming into existing with mergeFields, except that
+// the listed fields are combined as de-duplicated unions.
+func (m *merger) mergeObject(key, name string, existing, incoming map[string]any, lists ...string) []error {
+	errs := m.mergeFields(key, name, existing, incoming, lists...)
+	for _, k := range lists {
+		if v, ok := incoming[k]; ok {
+			existing[k] = unionList(asSlice(existing[k]), asSlice(v))
+		}
+	}
+	return errs
+}
+
+// mergeUnits merges systemd units field by field so an overlay can add a
+// drop-in (or enable a unit) without repeating the rest of it.
+func (m *merger) mergeUnits(name string, entries []map[string]any) []error {
+	return m.mergeByKey(name, "systemd", "units", "name", entries, func(key string, existing, incoming map[string]any) []error {
+		errs := m.mergeFields(key, name, existing, incoming, "dropins")
+		return append(errs, m.mergeDropins(key, name, existing, asSlice(incoming["dropins"]))...)
+	})
+}
+
+// userListFields are passwd.users fields merged as a de-duplicated union, so
+// an overlay can grant an extra SSH key or group without repeating the rest.
+var userListFields = []string{"sshAuthorizedKeys", "groups"}
+
+// mergeUsers merges passwd users by name: list fields are unioned and scalar
+// fields (homeDir, shell, uid, ...) conflict if set differently.
+func (m *merger) mergeUsers(name string, entries []map[string]any) []error {
+	return m.mergeByKey(name, "passwd", "users", "name", entries, m.fieldMerger(name, userListFields...))
+}
+
+// mergeGroups merges passwd groups by name; differing fields conflict.
+func (m *merger) mergeGroups(name string, entries []map[string]any) []error {
+	return m.mergeByKey(name, "passwd", "groups", "name", entries, m.fieldMerger(name))
+}
+
+// mergeDevices merges storage.disks or storage.filesystems by device. A
+// disk's partitions are merged by label, or by number if unlabelled.
+func (m *merger) mergeDevices(name, field string, entries []map[string]any) []error {
+	return m.mergeByKey(name, "storage", field, "device", entries, func(key string, existing, incoming map[string]any) []error {
+		errs := m.mergeFields(key, name, existing, incoming, "partitions")
+		if parts := asSlice(incoming["partitions"]); len(parts) > 0 {
+			arr, perrs := m.mergePartitions(key, name, asSlice(existing["partitions"]), parts)
+			existing["partitions"] = arr
+			errs = append(errs, perrs...)
+		}
+		return errs
+	})
+}
+
+// mergePartitions adds incoming partitions to a disk's existing ones.
+func (m *merger) mergePartitions(key, name string, existing, incoming []any) ([]any, []error) {
+	id := func(p map[string]any) string {
+		if label, _ := p["label"].(string); label != "" {
+			return label
+		}
+		if n, ok := p["number"].(float64); ok && n != 0 {
+			return fmt.Sprintf("#%d", int(n))
+		}
+		return ""
+	}
+	index := make(map[string]int)
+	for i, p := range existing {
+		if k := id(asMap(p)); k != "" {
+			index[k] = i
+		}
+	}
+	var errs []error
+	for _, p := range incoming {
+		pm := asMap(p)
+		k := id(pm)
+		i, exists := index[k]
+		if k == "" || !exists {
+			if k != "" {
+				index[k] = len(existing)
+				m.own(key+" partition "+k, name, pm)
+			}
+			existing = append(existing, p)
+			continue
+		}
+		errs = append(errs, m.mergeFields(key+" partition "+k, name, asMap(existing[i]), pm)...)
+	}
+	return existing, errs
+}
+
+// mergeIgnitionBlock merges the top-level ignition object. The first part
+// sets the version (validateIgnition reports parts that differ).
+func (m *merger) mergeIgnitionBlock(name string, src map[string]any) []error {
+	if len(src) == 0 {
+		return nil
+	}
+	dst := object(m.doc, "ignition")
+	if v, ok := src["version"]; ok {
+		if _, set := dst["version"]; !set {
+			dst["version"] = v
+		}
+	}
+	var errs []error
+	if c := asMap(src["config"]); c != nil {
+		errs = append(errs, unsupportedFields(name, "ignition.config", c, "merge", "replace")...)
+		errs = append(errs, m.mergeObject("ignition.config", name, object(dst, "config"), c, "merge")...)
+	}
+	if t := asMap(src["timeouts"]); t != nil {
+		errs = append(errs, m.mergeObject("ignition.timeouts", name, object(dst, "timeouts"), t)...)
+	}
+	if sec := asMap(src["security"]); sec != nil {
+		errs = append(errs, unsupportedFields(name, "ignition.security", sec, "tls")...)
+		if tls := asMap(sec["tls"]); tls != nil {
+			errs = append(errs, unsupportedFields(name, "ignition.security.tls", tls, "certificateAuthorities")...)
+			errs = append(errs, m.mergeObject("ignition.security.tls", name, object(object(dst, "security"), "tls"), tls, "certificateAuthorities")...)
+		}
+	}
+	if proxy := asMap(src["proxy"]); proxy != nil {
+		errs = append(errs, m.mergeObject("ignition.proxy", name, object(dst, "proxy"), proxy, "noProxy")...)
+	}
+	return errs
+}
+
+// mergeKernelArguments unions shouldExist and shouldNotExist, rejecting an
+// argument that ends up in both.
+func (m *merger) mergeKernelArguments(name string, src map[string]any) []error {
+	if len(src) == 0 {
+		return nil
+	}
+	dst := object(m.doc, "kernelArguments")
+	errs := m.mergeObject("kernelArguments", name, dst, src, "shouldExist", "shouldNotExist")
+	for _, arg := range asSlice(dst["shouldExist"]) {
+		introduced := containsValue(asSlice(src["shouldExist"]), arg) || containsValue(asSlice(src["shouldNotExist"]), arg)
+		if introduced && containsValue(asSlice(dst["shouldNotExist"]), arg) {
+			errs = append(errs, fmt.Errorf("%s: kernelArguments: %s is in both shouldExist and shouldNotExist", name, formatValue("", arg)))
+		}
+	}
+	return errs
+}
+
+// containsValue reports whether list holds a value equal to v.
+func containsValue(list []any, v any) bool {
+	for _, item := range list {
+		if formatValue("", item) == formatValue("", v) {
+			return true
+		}
+	}
+	return false
+}
+
+// unionList appends the items of b not already in a, keeping a's order.
+func unionList(a, b []any) []any {
+	out := append([]any{}, a...)
+	seen := make(map[string]bool)
+	for _, v := range a {
+		seen[formatValue("", v)] = true
+	}
+	for _, v := range b {
+		if k := formatValue("", v); !seen[k] {
+			seen[k] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// mergeDropins adds drop-ins to a unit by drop-in name. Identical drop-ins
+// collapse; same-named drop-ins with different contents are an error.
+func (m *merger) mergeDropins(key, name string, unit map[string]any, dropins []any) []error {
+	existing := asSlice(unit["dropins"])
+	var errs []error
+	for _, d := range dropins {
+		dm, _ := d.(map[string]any)
+		dn := fmt.Sprint(dm["name"])
+		found := false
+		for _, e := range existing {
+			em, _ := e.(map[string]any)
+			if fmt.Sprint(em["name"]) != dn {
+				continue
+			}
+			found = true
+			if a, b := formatValue("contents", em["contents"]), formatValue("contents", dm["contents"]); a != b {
+				errs = append(errs, fmt.Errorf("%s: drop-in %s from %s conflicts with the one from %s", key, dn, m.owner[key+".dropins."+dn], name))
+			}
+			break
+		}
+		if !found {
+			existing = append(existing, d)
+			m.owner[key+".dropins."+dn] = name
+		}
+	}
+	if len(existing) > 0 {
+		unit["dropins"] = existing
+	}
+	return errs
+}
+
+// Merge policies a .bu file can declare for a storage.files path it shares
+// with another part. The policy applies whichever of the parts declares it.
+const (
+	policyAppend  = "append"  // concatenate inline contents (the default)
+	policyReplace = "replace" // the later part's contents replace the earlier ones
+	policyError   = "error"   // sharing the path is a build error
+)
+
+// declaredPolicy is the merge policy a part declared for a path.
+type declaredPolicy struct {
+	policy, part string
+}
+
+// mergePolicyDirective declares a policy in a .bu file, conventionally just
+// above the file entry it applies to:
+//
+//	# merge-policy: /etc/quadsync/transforms/_base.container append
+var mergePolicyDirective = regexp.MustCompile(`^\s*#\s*merge-policy:\s*(.*?)\s*$`)
+
+// parseMergePolicies collects the merge-policy directives in a rendered
+// .bu file, so directives in an excluded "# @if" block don't count. Comment
+// lines inside YAML block scalars are file contents, not directives. The
+// rendered text no longer has the original line numbers, so errors quote
+// the directive instead.
+func parseMergePolicies(name, rendered string) (map[string]string, error) {
+	policies := make(map[string]string)
+	var context contextTracker
+	for _, line := range strings.Split(rendered, "\n") {
+		if context.next(line) != contextNone {
+			continue
+		}
+		match := mergePolicyDirective.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		directive := strings.TrimSpace(line)
+		fields := strings.Fields(match[1])
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "/") {
+			return nil, fmt.Errorf("%s: %q: want \"# merge-policy: /path append|replace|error\"", name, directive)
+		}
+		switch fields[1] {
+		case policyAppend, policyReplace, policyError:
+		default:
+			return nil, fmt.Errorf("%s: %q: unknown merge policy %q (want append, replace or error)", name, directive, fields[1])
+		}
+		if prev, dup := policies[fields[0]]; dup && prev != fields[1] {
+			return nil, fmt.Errorf("%s: %q: conflicting merge policies for %s", name, directive, fields[0])
+		}
+		policies[fields[0]] = fields[1]
+	}
+	return policies, nil
+}
+
+// mergeFiles adds storage.files entries from one part. An entry whose path is
+// already present is combined according to the policy declared for that
+// path by this part or an earlier one (see filePolicy). Mode and ownership
+// must agree whatever the policy. When append
+// isn't possible (a remote source), the later part's contents replace the
+// earlier ones and a warning is recorded.
+func (m *merger) mergeFiles(p ignPart, entries []map[string]any) []error {
+	if len(entries) == 0 {
+		return nil
+	}
+	sec, arr, index := m.keyIndex("storage", "files", "path")
+
+	var errs []error
+	for _, e := range entries {
+		path, _ := e["path"].(string)
+		key := entryKey("storage", "files", path)
+		i, exists := index[path]
+		if path == "" || !exists {
+			if path != "" {
+				index[path] = len(arr)
+				m.own(key, p.name, e)
+				m.sources.add(key, p.name, "")
+				if policy := p.policies[path]; policy != "" {
+					m.policies[path] = declaredPolicy{policy, p.name}
+				}
+			}
+			arr = append(arr, e)
+			continue
+		}
+		existing := arr[i].(map[string]any)
+		prevOwner := m.owner[key+".contents"]
+		errs = append(errs, m.mergeFields(key, p.name, existing, e, "contents")...)
+
+		policy, err := m.filePolicy(key, path, p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		switch policy {
+		case policyError:
+			errs = append(errs, fmt.Errorf("%s: already written by %s (merge policy %q in %s)", key, prevOwner, policyError, p.name))
+			continue
+		case policyAppend:
+			if strings.HasPrefix(path, transformsDir) {
+				if err := m.mergeTransform(key, path, prevOwner, p.name, existing, e); err == nil {
+					m.sources.add(key, p.name, explainSections)
+					continue
+				}
+			}
+			merged, err := concatDataURI(existing, e)
+			if err == nil {
+				arr[i] = merged
+				m.owner[key+".contents"] = prevOwner + "+" + p.name
+				m.sources.add(key, p.name, explainConcat)
+				continue
+			}
+			m.warnf("%s: cannot append %s contents to %s (%v); %s replaces them", key, p.name, prevOwner, err, p.name)
+		}
+		existing["contents"] = e["contents"]
+		m.owner[key+".contents"] = p.name
+		m.sources.add(key, p.name, explainOverride)
+		delete(m.ini, path)
+	}
+	sec["files"] = arr
+	return errs
+}
+
+// filePolicy returns the merge policy for a path p shares with earlier
+// parts: the one p or any earlier part declared, or append. Two different
+// declarations are an error naming both parts.
+func (m *merger) filePolicy(key, path string, p ignPart) (string, error) {
+	prev, declared := m.policies[path]
+	policy := p.policies[path]
+	switch {
+	case policy == "" && declared:
+		return prev.policy, nil
+	case policy == "":
+		return policyAppend, nil
+	case declared && policy != prev.policy:
+		return "", fmt.Errorf("%s: merge policy %q in %s conflicts with %q in %s", key, prev.policy, prev.part, policy, p.name)
+	case !declared:
+		m.policies[path] = declaredPolicy{policy, p.name}
+	}
+	return policy, nil
+}
+
+// mergeTransform appends a quadsync transform section by section (see
+// iniFile.merge) and records a warning for each overridden single-valued key.
+// It fails, leaving existing untouched, if either contents can't be decoded.
+func (m *merger) mergeTransform(key, path, prevOwner, name string, existing, incoming map[string]any) error {
+	aText, err := decodeDataURI(existing)
+	if err != nil {
+		return err
+	}
+	bText, err := decodeDataURI(incoming)
+	if err != nil {
+		return err
+	}
+	f, ok := m.ini[path]
+	if !ok {
+		f = parseINI(aText, prevOwner)
+		m.ini[path] = f
+	}
+	for _, w := range f.merge(parseINI(bText, name)) {
+		m.warnf("%s: %s", key, w)
+	}
+	existing["contents"] = map[string]any{"source": "data:," + url.PathEscape(f.render())}
+	m.owner[key+".contents"] = prevOwner + "+" + name
+	return nil
+}
+
+// concatDataURI concatenates the inline contents of two ignition file entries.
+// Returns the first entry with the combined content.
+func concatDataURI(a, b map[string]any) (map[string]any, error) {
+	aText, err := decodeDataURI(a)
+	if err != nil {
+		return nil, err
+	}
+	bText, err := decodeDataURI(b)
+	if err != nil {
+		return nil, err
+	}
+	// Ensure newline between concatenated sections
+	if !strings.HasSuffix(aText, "\n") {
+		aText += "\n"
+	}
+	combined := aText + bText
+	// Re-encode as plain data: URI (drop any compression from the originals)
+	result := make(map[string]any)
+	for k, v := range a {
+		result[k] = v
+	}
+	result["contents"] = map[string]any{
+		"source": "data:," + url.PathEscape(combined),
+	}
+	return result, nil
+}
+
+// decodeDataURI extracts the text content from an ignition file entry.
+// Handles URL-encoded and base64 data: URIs, optionally gzip-compressed.
+func decodeDataURI(entry map[string]any) (string, error) {
+	contents, ok := entry["contents"].(map[string]any)
+	if !ok {
+		return "", fmt.Errorf("no contents")
+	}
+	source, ok := contents["source"].(string)
+	if !ok {
+		return "", fmt.Errorf("no source")
+	}
+	compression, _ := contents["compression"].(string)
+
+	rest, ok := strings.CutPrefix(source, "data:")
+	if !ok {
+		return "", fmt.Errorf("not a data: URI")
+	}
+	header, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", fmt.Errorf("unsupported data URI format")
+	}
+
+	var data []byte
+	if strings.HasSuffix(header, ";base64") {
+		// data:;base64,<base64>, as butane writes it
+		decoded, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return "", err
+		}
+		data = decoded
+	} else {
+		// Plain URL-encoded: data:,content
+		decoded, err := url.PathUnescape(payload)
+		if err != nil {
+			return "", err
+		}
+		data = []byte(decoded)
+	}
+
+	switch compression {
+	case "":
+		return string(data), nil
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		out, err := io.ReadAll(gz)
+		if err != nil {
+			return "", err
+		}
+		return string(out), nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q", compression)
+	}
+}
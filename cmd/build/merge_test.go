@@ -0,0 +1,534 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergePartsDirectoriesByPath(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"ignition": {"version": "3.5.0"}, "storage": {"directories": [
+  {"path": "/etc/quadsync"}, {"path": "/etc/tailpod"}]}}`)},
+		{name: "tailscale.bu", ign: []byte(`{"ignition": {"version": "3.5.0"}, "storage": {"directories": [
+  {"path": "/etc/quadsync"}, {"path": "/etc/tailscale", "mode": 448}]}}`)},
+		{name: "server.bu", ign: []byte(`{"ignition": {"version": "3.5.0"}, "storage": {"directories": [
+  {"path": "/etc/tailscale", "mode": 448}]}}`)},
+	}
+	m, err := mergeParts(parts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	doc := m.doc
+	var paths []string
+	for _, d := range ignEntries(doc, "storage", "directories") {
+		paths = append(paths, d["path"].(string))
+	}
+	if got, want := strings.Join(paths, " "), "/etc/quadsync /etc/tailpod /etc/tailscale"; got != want {
+		t.Errorf("directories = %s, want %s", got, want)
+	}
+}
+
+func TestMergePartsFillsUnsetFields(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"storage": {"directories": [{"path": "/etc/quadsync"}]}}`)},
+		{name: "server.bu", ign: []byte(`{"storage": {"directories": [{"path": "/etc/quadsync", "mode": 493}]}}`)},
+	}
+	m, err := mergeParts(parts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	doc := m.doc
+	dirs := ignEntries(doc, "storage", "directories")
+	if len(dirs) != 1 || formatMode(dirs[0]["mode"]) != "0755" {
+		t.Errorf("directories = %v, want one /etc/quadsync with mode 0755", dirs)
+	}
+}
+
+func TestMergePartsPathConflicts(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"storage": {
+  "directories": [{"path": "/etc/quadsync", "mode": 493}],
+  "links": [{"path": "/etc/localtime", "target": "/usr/share/zoneinfo/UTC"}]}}`)},
+		{name: "tailscale.bu", ign: []byte(`{"storage": {"directories": [{"path": "/etc/quadsync", "mode": 448, "user": {"name": "core"}}]}}`)},
+		{name: "server.bu", ign: []byte(`{"storage": {
+  "directories": [{"path": "/etc/quadsync", "user": {"name": "root"}}],
+  "links": [{"path": "/etc/localtime", "target": "/usr/share/zoneinfo/Europe/Berlin"}]}}`)},
+	}
+	_, err := mergeParts(parts)
+	if err == nil {
+		t.Fatal("expected conflict error")
+	}
+	for _, want := range []string{
+		"storage.directories /etc/quadsync: mode 0755 (tailpod.bu) conflicts with 0700 (tailscale.bu)",
+		`storage.directories /etc/quadsync: user {"name":"core"} (tailscale.bu) conflicts with {"name":"root"} (server.bu)`,
+		`storage.links /etc/localtime: target "/usr/share/zoneinfo/UTC" (tailpod.bu) conflicts with "/usr/share/zoneinfo/Europe/Berlin" (server.bu)`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error missing %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestMergePartsDuplicatesWithinFirstPart(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"storage": {"directories": [{"path": "/etc/quadsync"}, {"path": "/etc/quadsync"}]}}`)},
+	}
+	m, err := mergeParts(parts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	doc := m.doc
+	if n := len(ignEntries(doc, "storage", "directories")); n != 1 {
+		t.Errorf("got %d directories, want 1", n)
+	}
+}
+
+func TestMergePartsUnitsByName(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"systemd": {"units": [
+  {"name": "quadsync-sync.service", "contents": "[Service]\nExecStart=/usr/local/bin/quadsync\n",
+   "dropins": [{"name": "10-env.conf", "contents": "[Service]\nEnvironment=A=1\n"}]}]}}`)},
+		{name: "tailscale.bu", ign: []byte(`{"systemd": {"units": [
+  {"name": "quadsync-sync.service", "enabled": true,
+   "dropins": [{"name": "10-env.conf", "contents": "[Service]\nEnvironment=A=1\n"},
+               {"name": "20-after.conf", "contents": "[Unit]\nAfter=tailscaled.service\n"}]}]}}`)},
+		{name: "server.bu", ign: []byte(`{"systemd": {"units": [
+  {"name": "quadsync-sync.service", "dropins": [{"name": "30-mount.conf", "contents": "[Unit]\nRequiresMountsFor=/var/mnt/storage\n"}]}]}}`)},
+	}
+	m, err := mergeParts(parts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	units := ignEntries(m.doc, "systemd", "units")
+	if len(units) != 1 {
+		t.Fatalf("got %d units, want 1", len(units))
+	}
+	u := units[0]
+	if enabled, _ := u["enabled"].(bool); !enabled {
+		t.Errorf("enabled = %v, want true", u["enabled"])
+	}
+	if _, ok := u["contents"].(string); !ok {
+		t.Errorf("contents lost: %v", u)
+	}
+	var names []string
+	for _, d := range asSlice(u["dropins"]) {
+		names = append(names, d.(map[string]any)["name"].(string))
+	}
+	if got, want := strings.Join(names, " "), "10-env.conf 20-after.conf 30-mount.conf"; got != want {
+		t.Errorf("dropins = %s, want %s", got, want)
+	}
+}
+
+func TestMergePartsUnitConflicts(t *testing.T) {
+	tests := []struct {
+		name          string
+		first, second string
+		want          string
+	}{
+		{
+			name:   "enabled",
+			first:  `{"name": "quadsync-sync.timer", "enabled": true}`,
+			second: `{"name": "quadsync-sync.timer", "enabled": false}`,
+			want:   "systemd.units quadsync-sync.timer: enabled true (tailpod.bu) conflicts with false (server.bu)",
+		},
+		{
+			name:   "mask",
+			first:  `{"name": "zincati.service", "mask": true}`,
+			second: `{"name": "zincati.service", "mask": false}`,
+			want:   "systemd.units zincati.service: mask true (tailpod.bu) conflicts with false (server.bu)",
+		},
+		{
+			name:   "contents",
+			first:  `{"name": "a.service", "contents": "[Service]\nExecStart=/bin/a\n"}`,
+			second: `{"name": "a.service", "contents": "[Service]\nExecStart=/bin/b\n"}`,
+			want:   "systemd.units a.service: contents from tailpod.bu conflicts with the one from server.bu",
+		},
+		{
+			name:   "dropin",
+			first:  `{"name": "a.service", "dropins": [{"name": "10.conf", "contents": "x"}]}`,
+			second: `{"name": "a.service", "dropins": [{"name": "10.conf", "contents": "y"}]}`,
+			want:   "systemd.units a.service: drop-in 10.conf from tailpod.bu conflicts with the one from server.bu",
+		},
+	}
+	for _, tt := range tests {
+		parts := []ignPart{
+			{name: "tailpod.bu", ign: []byte(`{"systemd": {"units": [` + tt.first + `]}}`)},
+			{name: "server.bu", ign: []byte(`{"systemd": {"units": [` + tt.second + `]}}`)},
+		}
+		_, err := mergeParts(parts)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestMergePartsUsersUnionLists(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"passwd": {"users": [
+  {"name": "core", "sshAuthorizedKeys": ["ssh-ed25519 AAAA base"], "groups": ["wheel"]}]}}`)},
+		{name: "ops.bu", ign: []byte(`{"passwd": {"users": [
+  {"name": "core", "sshAuthorizedKeys": ["ssh-ed25519 AAAA base", "ssh-ed25519 BBBB admin"], "shell": "/bin/bash"}]}}`)},
+		{name: "server.bu", ign: []byte(`{"passwd": {"users": [
+  {"name": "core", "groups": ["wheel", "sudo"], "shell": "/bin/bash"}]}}`)},
+	}
+	m, err := mergeParts(parts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	users := ignEntries(m.doc, "passwd", "users")
+	if len(users) != 1 {
+		t.Fatalf("got %d users, want 1", len(users))
+	}
+	core := users[0]
+	if got, want := formatValue("", core["sshAuthorizedKeys"]), `["ssh-ed25519 AAAA base","ssh-ed25519 BBBB admin"]`; got != want {
+		t.Errorf("sshAuthorizedKeys = %s, want %s", got, want)
+	}
+	if got, want := formatValue("", core["groups"]), `["wheel","sudo"]`; got != want {
+		t.Errorf("groups = %s, want %s", got, want)
+	}
+	if core["shell"] != "/bin/bash" {
+		t.Errorf("shell = %v", core["shell"])
+	}
+}
+
+func TestMergePartsUserScalarConflict(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"passwd": {"users": [{"name": "core", "homeDir": "/var/home/core", "passwordHash": "$y$j9T$first"}],
+  "groups": [{"name": "cusers", "gid": 1500}]}}`)},
+		{name: "server.bu", ign: []byte(`{"passwd": {"users": [{"name": "core", "homeDir": "/home/core", "passwordHash": "$y$j9T$second"}],
+  "groups": [{"name": "cusers", "gid": 1600}]}}`)},
+	}
+	_, err := mergeParts(parts)
+	for _, want := range []string{
+		`passwd.users core: homeDir "/var/home/core" (tailpod.bu) conflicts with "/home/core" (server.bu)`,
+		"passwd.users core: passwordHash from tailpod.bu conflicts with the one from server.bu",
+		"passwd.groups cusers: gid 1500 (tailpod.bu) conflicts with 1600 (server.bu)",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "j9T") {
+		t.Errorf("error %q quotes a password hash", err)
+	}
+}
+
+func TestMergePartsOtherSections(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"ignition": {"version": "3.5.0",
+    "proxy": {"httpsProxy": "http://proxy:3128", "noProxy": ["localhost"]},
+    "security": {"tls": {"certificateAuthorities": [{"source": "data:,ca1"}]}}},
+  "kernelArguments": {"shouldExist": ["console=ttyS0"]},
+  "storage": {"disks": [{"device": "/dev/sdb", "wipeTable": true, "partitions": [{"label": "data", "sizeMiB": 0}]}],
+    "filesystems": [{"device": "/dev/disk/by-partlabel/data", "format": "xfs", "path": "/var/mnt/storage"}]}}`)},
+		{name: "server.bu", ign: []byte(`{"ignition": {"version": "3.5.0",
+    "config": {"merge": [{"source": "https://example.com/extra.ign"}]},
+    "proxy": {"noProxy": ["localhost", ".internal"]},
+    "security": {"tls": {"certificateAuthorities": [{"source": "data:,ca1"}, {"source": "data:,ca2"}]}}},
+  "kernelArguments": {"shouldExist": ["console=ttyS0", "quiet"], "shouldNotExist": ["mitigations=off"]},
+  "storage": {"disks": [{"device": "/dev/sdb", "partitions": [{"label": "data", "sizeMiB": 0}, {"label": "swap", "sizeMiB": 4096}]}],
+    "filesystems": [{"device": "/dev/disk/by-partlabel/swap", "format": "swap"}],
+    "luks": [{"name": "secret", "device": "/dev/sdc"}],
+    "raid": [{"name": "md0", "level": "raid1", "devices": ["/dev/sdd", "/dev/sde"]}]}}`)},
+	}
+	m, err := mergeParts(parts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ign := m.doc["ignition"].(map[string]any)
+	for _, tt := range []struct {
+		got  any
+		want string
+	}{
+		{ign["version"], `"3.5.0"`},
+		{ign["proxy"], `{"httpsProxy":"http://proxy:3128","noProxy":["localhost",".internal"]}`},
+		{ign["config"], `{"merge":[{"source":"https://example.com/extra.ign"}]}`},
+		{ign["security"], `{"tls":{"certificateAuthorities":[{"source":"data:,ca1"},{"source":"data:,ca2"}]}}`},
+		{m.doc["kernelArguments"], `{"shouldExist":["console=ttyS0","quiet"],"shouldNotExist":["mitigations=off"]}`},
+		{ignEntries(m.doc, "storage", "disks")[0]["partitions"], `[{"label":"data","sizeMiB":0},{"label":"swap","sizeMiB":4096}]`},
+	} {
+		if got := formatValue("", tt.got); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+	for field, want := range map[string]int{"disks": 1, "filesystems": 2, "luks": 1, "raid": 1} {
+		if got := len(ignEntries(m.doc, "storage", field)); got != want {
+			t.Errorf("storage.%s: got %d entries, want %d", field, got, want)
+		}
+	}
+}
+
+func TestMergePartsOtherSectionConflicts(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"ignition": {"proxy": {"httpsProxy": "http://a:3128"}},
+  "kernelArguments": {"shouldExist": ["quiet"]},
+  "storage": {"filesystems": [{"device": "/dev/sdb1", "format": "xfs"}],
+    "disks": [{"device": "/dev/sdb", "partitions": [{"number": 1, "sizeMiB": 100}]}]}}`)},
+		{name: "server.bu", ign: []byte(`{"ignition": {"proxy": {"httpsProxy": "http://b:3128"}, "timeouts": {"httpTotal": 10}, "bogus": true},
+  "kernelArguments": {"shouldNotExist": ["quiet"]},
+  "storage": {"filesystems": [{"device": "/dev/sdb1", "format": "ext4"}],
+    "disks": [{"device": "/dev/sdb", "partitions": [{"number": 1, "sizeMiB": 200}]}],
+    "volumes": []},
+  "variant": "fcos"}`)},
+	}
+	_, err := mergeParts(parts)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{
+		`ignition.proxy: httpsProxy "http://a:3128" (tailpod.bu) conflicts with "http://b:3128" (server.bu)`,
+		`server.bu: kernelArguments: "quiet" is in both shouldExist and shouldNotExist`,
+		`storage.filesystems /dev/sdb1: format "xfs" (tailpod.bu) conflicts with "ext4" (server.bu)`,
+		"storage.disks /dev/sdb partition #1: sizeMiB 100 (tailpod.bu) conflicts with 200 (server.bu)",
+		"server.bu: ignition.bogus is not supported by the merge",
+		"server.bu: storage.volumes is not supported by the merge",
+		"server.bu: variant is not supported by the merge",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error missing %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestParseMergePolicies(t *testing.T) {
+	bu := `storage:
+  files:
+    # merge-policy: /etc/quadsync/transforms/_base.container append
+    - path: /etc/quadsync/transforms/_base.container
+    #merge-policy:   /etc/motd   replace
+    - path: /etc/motd
+`
+	got, err := parseMergePolicies("server.bu", bu)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got["/etc/quadsync/transforms/_base.container"] != policyAppend || got["/etc/motd"] != policyReplace {
+		t.Errorf("policies = %v", got)
+	}
+
+	// A directive-like line inside a block scalar is file contents.
+	got, err = parseMergePolicies("server.bu", `storage:
+  files:
+    - path: /etc/motd.sh
+      contents:
+        inline: |
+          #!/bin/sh
+          # merge-policy: /etc/motd error
+`)
+	if err != nil || len(got) != 0 {
+		t.Errorf("block scalar: policies = %v, %v, want none", got, err)
+	}
+
+	// So is one in a "# @if" block the site leaves out.
+	rendered, _, err := render("server.bu", `storage:
+  files:
+    # @if QUADSYNC_AGE_KEY
+    # merge-policy: /etc/motd error
+    # @end
+    - path: /etc/motd
+`, map[string]string{"QUADSYNC_AGE_KEY": ""}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := parseMergePolicies("server.bu", rendered); err != nil || len(got) != 0 {
+		t.Errorf("excluded block: policies = %v, %v, want none", got, err)
+	}
+
+	for _, bad := range []string{
+		"# merge-policy: /etc/motd overwrite",
+		"# merge-policy: etc/motd append",
+		"# merge-policy: /etc/motd",
+		"# merge-policy: /etc/motd append\n# merge-policy: /etc/motd error",
+	} {
+		if _, err := parseMergePolicies("server.bu", bad); err == nil || !strings.Contains(err.Error(), "server.bu: \"# merge-policy:") {
+			t.Errorf("%q: expected error quoting the directive, got %v", bad, err)
+		}
+	}
+}
+
+// fileParts builds two parts that both write path, with the second part
+// declaring policy (if any) for it.
+func fileParts(path, first, second, policy string) []ignPart {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"storage": {"files": [` + first + `]}}`)},
+		{name: "server.bu", ign: []byte(`{"storage": {"files": [` + second + `]}}`)},
+	}
+	if policy != "" {
+		parts[1].policies = map[string]string{path: policy}
+	}
+	return parts
+}
+
+func TestMergeFilesPolicies(t *testing.T) {
+	const path = "/etc/quadsync/notes.txt"
+	first := `{"path": "` + path + `", "mode": 420, "contents": {"source": "data:,%5BService%5D%0ARestart%3Don-failure%0A"}}`
+	second := `{"path": "` + path + `", "mode": 420, "contents": {"source": "data:,%5BUnit%5D%0AAfter%3Dx%0A"}}`
+
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{"", "[Service]\nRestart=on-failure\n[Unit]\nAfter=x\n"},
+		{policyAppend, "[Service]\nRestart=on-failure\n[Unit]\nAfter=x\n"},
+		{policyReplace, "[Unit]\nAfter=x\n"},
+	}
+	for _, tt := range tests {
+		m, err := mergeParts(fileParts(path, first, second, tt.policy))
+		if err != nil {
+			t.Fatalf("policy %q: unexpected error: %v", tt.policy, err)
+		}
+		files := ignEntries(m.doc, "storage", "files")
+		if len(files) != 1 {
+			t.Fatalf("policy %q: got %d files, want 1", tt.policy, len(files))
+		}
+		got, err := decodeDataURI(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("policy %q: contents = %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+
+	_, err := mergeParts(fileParts(path, first, second, policyError))
+	if err == nil || !strings.Contains(err.Error(), "already written by tailpod.bu") {
+		t.Errorf("policy error: got %v", err)
+	}
+}
+
+func TestMergeFilesEarlierPolicy(t *testing.T) {
+	const path = "/etc/motd"
+	first := `{"path": "` + path + `", "contents": {"source": "data:,a"}}`
+	second := `{"path": "` + path + `", "contents": {"source": "data:,b"}}`
+
+	// The earlier part's policy holds when the later one declares none.
+	parts := fileParts(path, first, second, "")
+	parts[0].policies = map[string]string{path: policyError}
+	if _, err := mergeParts(parts); err == nil || !strings.Contains(err.Error(), "already written by tailpod.bu") {
+		t.Errorf("earlier error policy: got %v", err)
+	}
+
+	parts = fileParts(path, first, second, policyReplace)
+	parts[0].policies = map[string]string{path: policyReplace}
+	if _, err := mergeParts(parts); err != nil {
+		t.Errorf("matching policies: unexpected error: %v", err)
+	}
+
+	parts = fileParts(path, first, second, policyReplace)
+	parts[0].policies = map[string]string{path: policyAppend}
+	want := `storage.files /etc/motd: merge policy "append" in tailpod.bu conflicts with "replace" in server.bu`
+	if _, err := mergeParts(parts); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("disagreeing policies: expected %q, got %v", want, err)
+	}
+}
+
+func TestMergeFilesModeConflict(t *testing.T) {
+	const path = "/etc/quadsync/transforms/_base.container"
+	first := `{"path": "` + path + `", "mode": 420, "contents": {"source": "data:,a"}}`
+	second := `{"path": "` + path + `", "mode": 384, "contents": {"source": "data:,b"}}`
+
+	for _, policy := range []string{"", policyReplace} {
+		_, err := mergeParts(fileParts(path, first, second, policy))
+		want := "storage.files " + path + ": mode 0644 (tailpod.bu) conflicts with 0600 (server.bu)"
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("policy %q: expected %q, got %v", policy, want, err)
+		}
+	}
+}
+
+func TestMergeFilesRemoteFallbackWarns(t *testing.T) {
+	const path = "/usr/local/bin/quadsync"
+	first := `{"path": "` + path + `", "contents": {"source": "https://example.com/a"}}`
+	second := `{"path": "` + path + `", "contents": {"source": "https://example.com/b"}}`
+
+	m, err := mergeParts(fileParts(path, first, second, ""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.warnings) != 1 || !strings.Contains(m.warnings[0], "cannot append server.bu contents to tailpod.bu") {
+		t.Errorf("warnings = %v", m.warnings)
+	}
+	if got := remoteSource(ignEntries(m.doc, "storage", "files")[0]); got != "https://example.com/b" {
+		t.Errorf("source = %q, want the later part's", got)
+	}
+
+	// An explicit replace is not a fallback
+	m, err = mergeParts(fileParts(path, first, second, policyReplace))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.warnings) != 0 {
+		t.Errorf("warnings = %v, want none", m.warnings)
+	}
+}
+
+func TestMergePartsFiles(t *testing.T) {
+	base := `{
+  "ignition": {"version": "3.4.0"},
+  "storage": {
+    "files": [{"path": "/etc/base"}],
+    "directories": [{"path": "/var/base"}]
+  },
+  "passwd": {
+    "users": [{"name": "core", "sshAuthorizedKeys": ["key1"]}]
+  },
+  "systemd": {
+    "units": [{"name": "base.service", "enabled": true}]
+  }
+}`
+
+	server := `{
+  "ignition": {"version": "3.4.0"},
+  "storage": {
+    "files": [{"path": "/etc/server"}]
+  },
+  "passwd": {
+    "users": [{"name": "core", "groups": ["docker"]}]
+  },
+  "systemd": {
+    "units": [{"name": "server.service", "enabled": true}]
+  }
+}`
+
+	m, err := mergeParts([]ignPart{{name: "base", ign: []byte(base)}, {name: "server", ign: []byte(server)}})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+
+	// Check files were concatenated
+	if files := ignEntries(m.doc, "storage", "files"); len(files) != 2 {
+		t.Errorf("got %d files, want 2", len(files))
+	}
+
+	// Check users were merged by name
+	users := ignEntries(m.doc, "passwd", "users")
+	if len(users) != 1 {
+		t.Fatalf("got %d users, want 1 (merged by name)", len(users))
+	}
+	coreUser := users[0]
+	if _, ok := coreUser["sshAuthorizedKeys"]; !ok {
+		t.Error("merged user missing sshAuthorizedKeys from base")
+	}
+	if _, ok := coreUser["groups"]; !ok {
+		t.Error("merged user missing groups from server")
+	}
+
+	// Check units were merged
+	if units := ignEntries(m.doc, "systemd", "units"); len(units) != 2 {
+		t.Errorf("got %d units, want 2", len(units))
+	}
+}
+
+func TestMergePartsEmptyServer(t *testing.T) {
+	base := `{"ignition": {"version": "3.4.0"}, "storage": {"files": [{"path": "/etc/base"}]}}`
+	server := `{"ignition": {"version": "3.4.0"}}`
+
+	m, err := mergeParts([]ignPart{{name: "base", ign: []byte(base)}, {name: "server", ign: []byte(server)}})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+
+	if files := ignEntries(m.doc, "storage", "files"); len(files) != 1 {
+		t.Errorf("got %d files, want 1", len(files))
+	}
+}
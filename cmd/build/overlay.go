@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// overlaysDir holds the optional .bu files merged over tailpod.bu.
+const overlaysDir = "overlays"
+
+// envVarName matches the variable names an overlay header may declare.
+var envVarName = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// overlay is an optional .bu file and the metadata from its header: the
+// leading block of "# key: value" comment lines, for example
+//
+//	# description: Tailscale networking for rootless containers
+//	# requires: TS_API_CLIENT_ID, TS_API_CLIENT_SECRET, TAILNET_DOMAIN
+//	# order: 10
+//
+// A variable can be given a type, as in "optional: METRICS_PORT:int" (see
+// varType). The header ends at the first line that isn't a comment.
+type overlay struct {
+	name        string // file name without .bu, e.g. "tailscale"
+	path        string
+	description string
+	required    []string           // site.env variables the overlay needs
+	optional    []string           // site.env variables it uses if set
+	types       map[string]varType // declared types of those that aren't strings
+	order       int                // lower merges first, among overlays not ordered by after/depends
+	after       []string           // overlays merged before this one, if present
+	depends     []string           // overlays that must be present and merged before this one
+}
+
+// file is the overlay's .bu file name, which labels its merge part.
+func (o overlay) file() string {
+	return o.name + ".bu"
+}
+
+// parseOverlayHeader reads an overlay's header block. Every line in it must
+// be a known key; a description is required so a .bu file without a header
+// is caught rather than merged with no declared variables.
+func parseOverlayHeader(path, data string) (overlay, error) {
+	o := overlay{name: strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".example"), ".bu"), path: path}
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return o, fmt.Errorf("%s line %d: header line is not \"# key: value\"; end the header with a blank line before other comments", path, i+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		list := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		switch key {
+		case "description":
+			o.description = value
+		case "requires", "optional":
+			for j, v := range list {
+				name, typ, typed := strings.Cut(v, ":")
+				if !envVarName.MatchString(name) {
+					return o, fmt.Errorf("%s line %d: invalid variable name %q", path, i+1, name)
+				}
+				if typed {
+					t, err := parseVarType(typ)
+					if err != nil {
+						return o, fmt.Errorf("%s line %d: %s: %w", path, i+1, name, err)
+					}
+					if o.types == nil {
+						o.types = make(map[string]varType)
+					}
+					o.types[name] = t
+				}
+				list[j] = name
+			}
+			if key == "requires" {
+				o.required = append(o.required, list...)
+			} else {
+				o.optional = append(o.optional, list...)
+			}
+		case "order":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return o, fmt.Errorf("%s line %d: order %q is not an integer", path, i+1, value)
+			}
+			o.order = n
+		case "after", "depends":
+			for j, v := range list {
+				list[j] = strings.TrimSuffix(v, ".bu")
+			}
+			if key == "after" {
+				o.after = append(o.after, list...)
+			} else {
+				o.depends = append(o.depends, list...)
+			}
+		default:
+			return o, fmt.Errorf("%s line %d: unknown header key %q (want description, requires, optional, order, after or depends)", path, i+1, key)
+		}
+	}
+	if o.description == "" {
+		return o, fmt.Errorf("%s: missing overlay header (start the file with \"# description: ...\")", path)
+	}
+	return o, nil
+}
+
+// discoverOverlays reads the header of every .bu file in dirs. An overlay in
+// a later directory replaces one with the same name from an earlier one, so a
+// site can carry its own copy of a shared overlay. Missing directories are
+// skipped. The result is sorted by name; selectOverlays puts the ones that
+// are built in merge order.
+func discoverOverlays(dirs ...string) ([]overlay, error) {
+	byName := make(map[string]overlay)
+	for _, dir := range dirs {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.bu"))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			if filepath.Base(p) == "tailpod.bu" {
+				continue
+			}
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return nil, err
+			}
+			o, err := parseOverlayHeader(p, string(data))
+			if err != nil {
+				return nil, err
+			}
+			byName[o.name] = o
+		}
+	}
+	overlays := make([]overlay, 0, len(byName))
+	for _, o := range byName {
+		overlays = append(overlays, o)
+	}
+	sort.Slice(overlays, func(i, j int) bool { return overlays[i].name < overlays[j].name })
+	return overlays, nil
+}
+
+// selectOverlays returns the overlays to build, in merge order, and the
+// present ones left out. selection names the overlays to build (from
+// --overlay or OVERLAYS, described by source); nil selects every overlay
+// found. Overlays named in without are then dropped. Naming an overlay that
+// doesn't exist is an error either way, naming the dirs all was found in.
+func selectOverlays(all []overlay, dirs, selection []string, source string, without []string) (selected, skipped []overlay, err error) {
+	present := make(map[string]bool, len(all))
+	for _, o := range all {
+		present[o.name] = true
+	}
+	want := make(map[string]bool, len(all))
+	if selection == nil {
+		for _, o := range all {
+			want[o.name] = true
+		}
+	}
+	for _, n := range selection {
+		n = strings.TrimSuffix(n, ".bu")
+		if !present[n] {
+			return nil, nil, fmt.Errorf("%s selects overlay %q, but there is no %s", source, n, overlayFiles(dirs, n))
+		}
+		want[n] = true
+	}
+	for _, n := range without {
+		n = strings.TrimSuffix(n, ".bu")
+		if !present[n] {
+			return nil, nil, fmt.Errorf("--without %q: there is no %s", n, overlayFiles(dirs, n))
+		}
+		delete(want, n)
+	}
+
+	for _, o := range all {
+		if want[o.name] {
+			selected = append(selected, o)
+		} else {
+			skipped = append(skipped, o)
+		}
+	}
+	selected, err = orderOverlays(selected)
+	return selected, skipped, err
+}
+
+// overlayFiles lists the files overlay n could have been read from, for
+// errors: "overlays/server.bu or sites/alpha/server.bu".
+func overlayFiles(dirs []string, n string) string {
+	paths := make([]string, len(dirs))
+	for i, d := range dirs {
+		paths[i] = filepath.Join(d, n+".bu")
+	}
+	return strings.Join(paths, " or ")
+}
+
+// splitList splits a comma-separated list, dropping blanks. An empty string
+// gives an empty, non-nil list.
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// overlayTemplates reads the headers of the .bu.example files in dir. They
+// aren't merged, but their variables may already be set in site.env.
+func overlayTemplates(dir string) ([]overlay, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.bu.example"))
+	if err != nil {
+		return nil, err
+	}
+	var templates []overlay
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		o, err := parseOverlayHeader(p, string(data))
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, o)
+	}
+	return templates, nil
+}
+
+// orderOverlays sorts overlays so each comes after the ones it names in
+// after and depends, and otherwise by order then name. A depends entry must
+// name a present overlay; an after entry naming an absent one is ignored.
+// Cycles are an error.
+func orderOverlays(overlays []overlay) ([]overlay, error) {
+	sort.Slice(overlays, func(i, j int) bool {
+		if overlays[i].order != overlays[j].order {
+			return overlays[i].order < overlays[j].order
+		}
+		return overlays[i].name < overlays[j].name
+	})
+	index := make(map[string]int, len(overlays))
+	for i, o := range overlays {
+		index[o.name] = i
+	}
+	// deps[i] are the overlays i must be merged after.
+	deps := make([][]int, len(overlays))
+	for i, o := range overlays {
+		for _, d := range o.depends {
+			j, ok := index[d]
+			if !ok {
+				return nil, fmt.Errorf("%s: depends on overlay %q, which is not in the build", o.path, d)
+			}
+			deps[i] = append(deps[i], j)
+		}
+		for _, a := range o.after {
+			if j, ok := index[a]; ok {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+
+	placed := make([]bool, len(overlays))
+	ready := func(i int) bool {
+		for _, j := range deps[i] {
+			if !placed[j] {
+				return false
+			}
+		}
+		return true
+	}
+	sorted := make([]overlay, 0, len(overlays))
+	for len(sorted) < len(overlays) {
+		// overlays is sorted by order and name, so the first ready one goes next.
+		next := -1
+		for i := range overlays {
+			if !placed[i] && ready(i) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, overlayCycle(overlays, deps, placed)
+		}
+		placed[next] = true
+		sorted = append(sorted, overlays[next])
+	}
+	return sorted, nil
+}
+
+// overlayCycle describes a dependency cycle among the overlays not yet
+// placed. Every unplaced overlay waits on another unplaced one, so following
+// those edges from any of them must revisit one.
+func overlayCycle(overlays []overlay, deps [][]int, placed []bool) error {
+	i := 0
+	for placed[i] {
+		i++
+	}
+	seen := make(map[int]int) // overlay -> position in path
+	var path []string
+	for {
+		if start, ok := seen[i]; ok {
+			return fmt.Errorf("overlay dependency cycle: %s -> %s", strings.Join(path[start:], " -> "), overlays[i].name)
+		}
+		seen[i] = len(path)
+		path = append(path, overlays[i].name)
+		for _, j := range deps[i] {
+			if !placed[j] {
+				i = j
+				break
+			}
+		}
+	}
+}
+
+// checkLegacyOverlays fails if overlays are still next to tailpod.bu, where
+// they were read from before the overlays/ directory.
+func checkLegacyOverlays() error {
+	paths, err := filepath.Glob("*.bu")
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if p != "tailpod.bu" {
+			return fmt.Errorf("%s: overlays are read from %s/; move it to %s", p, overlaysDir, filepath.Join(overlaysDir, p))
+		}
+	}
+	return nil
+}
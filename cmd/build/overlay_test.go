@@ -0,0 +1,252 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testAllowed returns the variables the repository's own overlays and
+// overlay templates declare, as buildSite would allow them.
+func testAllowed(t *testing.T) map[string]varType {
+	t.Helper()
+	dir := filepath.Join("..", "..", overlaysDir)
+	overlays, err := discoverOverlays(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := overlayTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, err := allowedVars(append(templates, overlays...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return allowed
+}
+
+// writeOverlay writes dir/name.bu with the given header lines.
+func writeOverlay(t *testing.T, dir, name string, header ...string) {
+	t.Helper()
+	var sb strings.Builder
+	for _, h := range header {
+		sb.WriteString("# " + h + "\n")
+	}
+	sb.WriteString("\nvariant: fcos\nversion: 1.6.0\n")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".bu"), []byte(sb.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func overlayNames(overlays []overlay) string {
+	var names []string
+	for _, o := range overlays {
+		names = append(names, o.name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestRepoOverlays(t *testing.T) {
+	overlays, err := discoverOverlays(filepath.Join("..", "..", overlaysDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := overlayNames(overlays), "registry tailscale"; got != want {
+		t.Errorf("overlays = %s, want %s", got, want)
+	}
+	allowed := testAllowed(t)
+	for _, v := range []string{"SSH_PUBKEY", "TAILPOD_ARCH", "TS_API_CLIENT_SECRET", "REGISTRY_AUTH_B64", "STORAGE_SMB_PASSWORD"} {
+		if _, ok := allowed[v]; !ok {
+			t.Errorf("%s not allowed", v)
+		}
+	}
+}
+
+func TestParseOverlayHeader(t *testing.T) {
+	data := `# description: Metrics exporter
+# requires: METRICS_TOKEN, METRICS_URL
+# optional: METRICS_INTERVAL
+# order: 40
+# after: tailscale.bu
+# depends: server
+
+# Other comments follow the header after a blank line: like this one.
+variant: fcos
+`
+	o, err := parseOverlayHeader("overlays/monitoring.bu", data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o.name != "monitoring" || o.description != "Metrics exporter" || o.order != 40 {
+		t.Errorf("got %+v", o)
+	}
+	if got := strings.Join(o.required, " "); got != "METRICS_TOKEN METRICS_URL" {
+		t.Errorf("required = %s", got)
+	}
+	if got := strings.Join(o.optional, " "); got != "METRICS_INTERVAL" {
+		t.Errorf("optional = %s", got)
+	}
+	if got := strings.Join(append(o.after, o.depends...), " "); got != "tailscale server" {
+		t.Errorf("after, depends = %s", got)
+	}
+}
+
+func TestParseOverlayHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"no header", "variant: fcos\n", "missing overlay header"},
+		{"unknown key", "# description: x\n# require: FOO\n", `line 2: unknown header key "require"`},
+		{"prose", "# description: x\n# Installs the exporter\n", "line 2: header line is not"},
+		{"bad var", "# description: x\n# requires: foo\n", `invalid variable name "foo"`},
+		{"bad order", "# description: x\n# order: first\n", `order "first" is not an integer`},
+	}
+	for _, tt := range tests {
+		_, err := parseOverlayHeader("overlays/x.bu", tt.data)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestSelectOverlaysOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeOverlay(t, dir, "tailscale", "description: t", "order: 10")
+	writeOverlay(t, dir, "server", "description: s", "order: 30")
+	writeOverlay(t, dir, "registry", "description: r", "order: 20")
+	writeOverlay(t, dir, "monitoring", "description: m", "depends: server", "after: absent")
+	writeOverlay(t, dir, "alpha", "description: a")
+
+	all, err := discoverOverlays(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	overlays, _, err := selectOverlays(all, []string{dir}, nil, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := overlayNames(overlays), "alpha tailscale registry server monitoring"; got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+}
+
+func TestDiscoverOverlaysSiteCopyWins(t *testing.T) {
+	shared, siteDir := t.TempDir(), t.TempDir()
+	writeOverlay(t, shared, "server", "description: shared")
+	writeOverlay(t, siteDir, "server", "description: site", "requires: STORAGE_SMB_HOST")
+
+	overlays, err := discoverOverlays(shared, siteDir, filepath.Join(shared, "missing"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(overlays) != 1 || overlays[0].description != "site" || overlays[0].path != filepath.Join(siteDir, "server.bu") {
+		t.Errorf("got %+v, want the site copy", overlays)
+	}
+}
+
+func TestSelectOverlaysRejectsCycles(t *testing.T) {
+	dir := t.TempDir()
+	writeOverlay(t, dir, "a", "description: a", "after: c")
+	writeOverlay(t, dir, "b", "description: b", "depends: a")
+	writeOverlay(t, dir, "c", "description: c", "after: b")
+
+	all, err := discoverOverlays(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = selectOverlays(all, []string{dir}, nil, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "overlay dependency cycle: a -> c -> b -> a") {
+		t.Errorf("expected cycle error, got %v", err)
+	}
+}
+
+func TestSelectOverlaysMissingDependency(t *testing.T) {
+	dir := t.TempDir()
+	writeOverlay(t, dir, "monitoring", "description: m", "depends: server")
+	writeOverlay(t, dir, "server", "description: s")
+
+	all, err := discoverOverlays(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = selectOverlays(all, []string{dir}, nil, "", []string{"server"})
+	if err == nil || !strings.Contains(err.Error(), `depends on overlay "server", which is not in the build`) {
+		t.Errorf("expected missing dependency error, got %v", err)
+	}
+}
+
+func TestSelectOverlays(t *testing.T) {
+	dir := t.TempDir()
+	writeOverlay(t, dir, "tailscale", "description: t", "order: 10")
+	writeOverlay(t, dir, "registry", "description: r", "order: 20")
+	writeOverlay(t, dir, "server", "description: s", "order: 30")
+	all, err := discoverOverlays(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		selection, without []string
+		selected, skipped  string
+	}{
+		{nil, nil, "tailscale registry server", ""},
+		{nil, []string{"server"}, "tailscale registry", "server"},
+		{[]string{"server.bu", "tailscale"}, nil, "tailscale server", "registry"},
+		{[]string{"server", "tailscale"}, []string{"server"}, "tailscale", "registry server"},
+		{[]string{}, nil, "", "registry server tailscale"},
+	}
+	for _, tt := range tests {
+		selected, skipped, err := selectOverlays(all, []string{dir}, tt.selection, "OVERLAYS in site.env", tt.without)
+		if err != nil {
+			t.Fatalf("%v without %v: %v", tt.selection, tt.without, err)
+		}
+		if got := overlayNames(selected); got != tt.selected {
+			t.Errorf("%v without %v: selected %q, want %q", tt.selection, tt.without, got, tt.selected)
+		}
+		if got := overlayNames(skipped); got != tt.skipped {
+			t.Errorf("%v without %v: skipped %q, want %q", tt.selection, tt.without, got, tt.skipped)
+		}
+	}
+
+	_, _, err = selectOverlays(all, []string{dir}, []string{"monitoring"}, "OVERLAYS in site.env", nil)
+	if err == nil || !strings.Contains(err.Error(), `OVERLAYS in site.env selects overlay "monitoring", but there is no `+filepath.Join(dir, "monitoring.bu")) {
+		t.Errorf("expected missing overlay error, got %v", err)
+	}
+	siteDir := filepath.Join(dir, "sites", "alpha")
+	_, _, err = selectOverlays(all, []string{dir, siteDir}, nil, "", []string{"monitoring"})
+	if err == nil || !strings.Contains(err.Error(), `--without "monitoring": there is no `+filepath.Join(dir, "monitoring.bu")+" or "+filepath.Join(siteDir, "monitoring.bu")) {
+		t.Errorf("expected unknown --without error, got %v", err)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	if got := splitList(""); got == nil || len(got) != 0 {
+		t.Errorf("splitList(\"\") = %#v, want empty non-nil", got)
+	}
+	if got := strings.Join(splitList(" tailscale, ,server "), "|"); got != "tailscale|server" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestParseOverlayHeaderTypes(t *testing.T) {
+	o, err := parseOverlayHeader("overlays/metrics.bu", "# description: Metrics\n# requires: METRICS_TOKEN\n# optional: METRICS_PORT:int, METRICS_TARGETS:list\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(o.optional, " "); got != "METRICS_PORT METRICS_TARGETS" {
+		t.Errorf("optional = %s", got)
+	}
+	if o.types["METRICS_PORT"] != typeInt || o.types["METRICS_TARGETS"] != typeList || o.types["METRICS_TOKEN"] != "" {
+		t.Errorf("types = %v", o.types)
+	}
+
+	_, err = parseOverlayHeader("overlays/metrics.bu", "# description: Metrics\n# optional: METRICS_PORT:port\n")
+	if err == nil || !strings.Contains(err.Error(), `overlays/metrics.bu line 2: METRICS_PORT: unknown type "port"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// baseScope is the site.env variables tailpod.bu sees.
+func baseScope() []string {
+	names := append([]string(nil), optionalBaseVars...)
+	for k := range requiredVars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scope is the site.env variables an overlay sees: the ones it declares plus
+// the base required set. Secrets for one overlay can't leak into another.
+func (o overlay) scope() []string {
+	names := append(append([]string(nil), o.required...), o.optional...)
+	for k := range requiredVars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scopeVars returns the values a .bu file is rendered with: the named
+// variables that are set, plus the build-provided ones (TAILPOD_BUILD and
+// the release binaries in binVars), which aren't secrets. Optional variables
+// that aren't set render as empty.
+func scopeVars(vars, binVars map[string]string, names, optional []string) map[string]string {
+	scoped := make(map[string]string, len(names)+len(binVars)+1)
+	for k, v := range binVars {
+		scoped[k] = v
+	}
+	if v, ok := vars["TAILPOD_BUILD"]; ok {
+		scoped["TAILPOD_BUILD"] = v
+	}
+	for _, n := range optional {
+		scoped[n] = ""
+	}
+	for _, n := range names {
+		if v, ok := vars[n]; ok {
+			scoped[n] = v
+		}
+	}
+	return scoped
+}
+
+// checkScope reports each ${VAR} reference in content to a site.env variable
+// (one in allowed) that is outside scope, with its line number.
+func checkScope(name, content string, scope []string, allowed map[string]varType) error {
+	var errs []error
+	for i, line := range strings.Split(content, "\n") {
+		for _, m := range varRef.FindAllStringSubmatch(line, -1) {
+			v := m[1]
+			if _, declared := allowed[v]; declared && !strings.HasPrefix(m[0], "$$") && !slices.Contains(scope, v) {
+				errs = append(errs, fmt.Errorf("%s line %d: ${%s} is not in scope for this file (an overlay must declare it in its header's requires: or optional:)", name, i+1, v))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkScopes runs checkScope over tailpod.bu and each overlay.
+func checkScopes(overlays []overlay, allowed map[string]varType) error {
+	data, err := os.ReadFile("tailpod.bu")
+	if err != nil {
+		return fmt.Errorf("reading tailpod.bu: %w", err)
+	}
+	errs := []error{checkScope("tailpod.bu", string(data), baseScope(), allowed)}
+	for _, o := range overlays {
+		data, err := os.ReadFile(o.path)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", o.path, err)
+		}
+		errs = append(errs, checkScope(o.path, string(data), o.scope(), allowed))
+	}
+	return errors.Join(errs...)
+}
+
+// unusedVars returns the variables set in vars that neither tailpod.bu nor
+// any of overlays declares, sorted.
+func unusedVars(vars map[string]string, overlays []overlay) []string {
+	used := make(map[string]bool)
+	for _, v := range baseScope() {
+		used[v] = true
+	}
+	for _, o := range overlays {
+		for _, v := range o.scope() {
+			used[v] = true
+		}
+	}
+	var unused []string
+	for k := range vars {
+		if !used[k] {
+			unused = append(unused, k)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
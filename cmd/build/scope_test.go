@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOverlayScope(t *testing.T) {
+	o := overlay{name: "server", required: []string{"STORAGE_SMB_HOST"}, optional: []string{"STORAGE_SMB_PORT"}}
+	got := strings.Join(o.scope(), " ")
+	want := "QUADSYNC_GIT_BRANCH QUADSYNC_GIT_URL SSH_PUBKEY STORAGE_SMB_HOST STORAGE_SMB_PORT"
+	if got != want {
+		t.Errorf("scope = %s, want %s", got, want)
+	}
+	if strings.Contains(strings.Join(baseScope(), " "), "STORAGE") {
+		t.Errorf("base scope includes overlay variables: %v", baseScope())
+	}
+}
+
+func TestScopeVars(t *testing.T) {
+	vars := map[string]string{
+		"SSH_PUBKEY":           "key",
+		"TS_API_CLIENT_SECRET": "secret",
+		"STORAGE_SMB_HOST":     "host",
+		"TAILPOD_BUILD":        "abc123",
+	}
+	bin := map[string]string{"TAILMINT_URL": "https://example.com/tailmint"}
+	scoped := scopeVars(vars, bin, []string{"SSH_PUBKEY", "STORAGE_SMB_HOST", "STORAGE_SMB_PORT"}, []string{"STORAGE_SMB_PORT"})
+
+	out := substitute("${SSH_PUBKEY} ${STORAGE_SMB_HOST} ${TS_API_CLIENT_SECRET} ${TAILMINT_URL} ${TAILPOD_BUILD} [${STORAGE_SMB_PORT}]", scoped)
+	if want := "key host ${TS_API_CLIENT_SECRET} https://example.com/tailmint abc123 []"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestCheckScope(t *testing.T) {
+	allowed := map[string]varType{"SSH_PUBKEY": typeString, "STORAGE_SMB_HOST": typeString, "TS_API_CLIENT_SECRET": typeString}
+	content := `# description: storage
+storage:
+  files:
+    - path: /etc/samba/host
+      contents:
+        inline: ${STORAGE_SMB_HOST} ${SSH_PUBKEY}
+    - path: /etc/leak
+      contents:
+        inline: ${TS_API_CLIENT_SECRET} ${TAILMINT_URL} ${1-} $HOME
+`
+	o := overlay{name: "server", required: []string{"STORAGE_SMB_HOST"}}
+	err := checkScope("overlays/server.bu", content, o.scope(), allowed)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := "overlays/server.bu line 9: ${TS_API_CLIENT_SECRET} is not in scope"; !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not contain %q", err, want)
+	}
+	if strings.Count(err.Error(), "not in scope") != 1 {
+		t.Errorf("expected exactly one problem, got %v", err)
+	}
+}
+
+func TestUnusedVars(t *testing.T) {
+	vars := map[string]string{
+		"SSH_PUBKEY":       "key",
+		"TAILPOD_ARCH":     "arm64",
+		"TS_API_CLIENT_ID": "id",
+		"STORAGE_SMB_HOST": "host",
+	}
+	overlays := []overlay{{name: "tailscale", required: []string{"TS_API_CLIENT_ID"}}}
+	if got := strings.Join(unusedVars(vars, overlays), " "); got != "STORAGE_SMB_HOST" {
+		t.Errorf("unused = %q, want STORAGE_SMB_HOST", got)
+	}
+}
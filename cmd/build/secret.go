@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A site.env value written as secret:REF is fetched from an external secret
+// store, such as a password manager, by the resolver command named in
+// $TAILPOD_SECRET_RESOLVER. The command is run directly, without a shell,
+// once per site, with a request on stdin:
+//
+//	{"version": 1, "refs": ["ops/tailscale-oauth"]}
+//
+// It writes the values, and an error for each ref it can't resolve, to
+// stdout:
+//
+//	{"values": {"ops/tailscale-oauth": "tskey-client-..."}, "errors": {}}
+//
+// A non-zero exit fails the build with the command's stderr.
+const (
+	secretPrefix      = "secret:"
+	secretResolverEnv = "TAILPOD_SECRET_RESOLVER"
+)
+
+// resolverMu serializes resolver runs so that unlock prompts from sites
+// building in parallel don't interleave.
+var resolverMu sync.Mutex
+
+type resolveRequest struct {
+	Version int      `json:"version"`
+	Refs    []string `json:"refs"`
+}
+
+type resolveResponse struct {
+	Values map[string]string `json:"values"`
+	Errors map[string]string `json:"errors"`
+}
+
+// checkSecretRef reports whether ref is usable as the secret: reference of
+// a variable of type t. Only strings can be secrets: lists, bools and ints
+// control the build and are quoted in its errors.
+func checkSecretRef(ref string, t varType) error {
+	if t != typeString {
+		return fmt.Errorf("is a %s variable; only string variables can be %s references", t, secretPrefix)
+	}
+	if ref == "" || strings.ContainsFunc(ref, func(r rune) bool { return r < ' ' }) {
+		return fmt.Errorf("%s needs a reference to the secret, e.g. %sops/tailscale-oauth", secretPrefix, secretPrefix)
+	}
+	return nil
+}
+
+// resolveSecrets replaces the value of each variable in l given as a
+// secret: reference with the value the resolver returns for it. Errors name
+// the variable and its reference, never the value.
+func resolveSecrets(l *envLayers) error {
+	if len(l.secret) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(l.secret))
+	seen := make(map[string]bool)
+	var refs []string
+	for k, ref := range l.secret {
+		keys = append(keys, k)
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(keys)
+	sort.Strings(refs)
+
+	resolver := strings.Fields(os.Getenv(secretResolverEnv))
+	if len(resolver) == 0 {
+		k := keys[0]
+		return fmt.Errorf("%s: %s is %s%s, but %s is not set; set it to the command that fetches secrets", l.source[k], k, secretPrefix, l.secret[k], secretResolverEnv)
+	}
+	resp, err := runResolver(resolver, refs)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, k := range keys {
+		ref := l.secret[k]
+		v, ok := resp.Values[ref]
+		switch {
+		case resp.Errors[ref] != "":
+			errs = append(errs, fmt.Errorf("%s: %s: %s%s: %s", l.source[k], k, secretPrefix, ref, resp.Errors[ref]))
+		case !ok:
+			errs = append(errs, fmt.Errorf("%s: %s: the secret resolver returned no value for %s%s", l.source[k], k, secretPrefix, ref))
+		default:
+			l.vars[k] = v
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runResolver runs the resolver command for refs and decodes its response.
+// Its output holds secrets, so it is never quoted in an error.
+func runResolver(resolver, refs []string) (*resolveResponse, error) {
+	req, err := json.Marshal(resolveRequest{Version: 1, Refs: refs})
+	if err != nil {
+		return nil, err
+	}
+
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(resolver[0], resolver[1:]...)
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("secret resolver %s: %w\n%s", resolver[0], err, msg)
+		}
+		return nil, fmt.Errorf("secret resolver %s: %w", resolver[0], err)
+	}
+	var resp resolveResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("secret resolver %s: output is not a JSON response of the form {\"values\": {...}, \"errors\": {...}}", resolver[0])
+	}
+	return &resp, nil
+}
+
+// secretValues returns the resolved values of the variables in l that were
+// given as secret: references, for redaction.
+func (l *envLayers) secretValues() redactor {
+	var r redactor
+	for k := range l.secret {
+		if v := l.vars[k]; v != "" {
+			r = append(r, v)
+		}
+	}
+	// Longest first, so a secret containing another is replaced whole.
+	sort.Slice(r, func(i, j int) bool { return len(r[i]) > len(r[j]) })
+	return r
+}
+
+// A redactor holds resolved secret values. They reach the rendered
+// Butane, so butane, validation and merge messages can quote them; every
+// error and warning of a site passes through its redactor before it is
+// printed.
+type redactor []string
+
+// redacted replaces a resolved secret value.
+const redacted = "<redacted>"
+
+func (r redactor) redact(text string) string {
+	for _, v := range r {
+		text = strings.ReplaceAll(text, v, redacted)
+	}
+	return text
+}
+
+// redactErr returns err, or a copy with its secrets redacted if it quotes
+// any.
+func (r redactor) redactErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if msg := r.redact(err.Error()); msg != err.Error() {
+		return errors.New(msg)
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withFakeResolver installs a resolver script that saves its request to
+// $RESOLVER_REQUEST and runs body, and returns the request file.
+func withFakeResolver(t *testing.T, body string) string {
+	t.Helper()
+	dir := t.TempDir()
+	script := writeFile(t, filepath.Join(dir, "resolver"), "#!/bin/sh\ncat > \"$RESOLVER_REQUEST\"\n"+body)
+	if err := os.Chmod(script, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The argument is passed as is: a shell would expand it.
+	t.Setenv(secretResolverEnv, script+" --vault=$HOME")
+	req := filepath.Join(dir, "request")
+	t.Setenv("RESOLVER_REQUEST", req)
+	return req
+}
+
+func secretLayers(t *testing.T, env string) *envLayers {
+	t.Helper()
+	site := writeFile(t, filepath.Join(t.TempDir(), "site.env"), env)
+	l, err := siteEnvLayers(nil, site, testAllowed(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestResolveSecrets(t *testing.T) {
+	req := withFakeResolver(t, `[ "$1" = '--vault=$HOME' ] || exit 1
+echo '{"values": {"ops/tailscale": "tskey-client-s3cret", "ops/smb": "pa$$word"}}'
+`)
+	l := secretLayers(t, `TS_API_CLIENT_SECRET=secret:ops/tailscale
+STORAGE_SMB_PASSWORD=secret:ops/smb
+STORAGE_SMB_USER=secret:ops/smb
+TAILNET_DOMAIN=example.ts.net
+`)
+	if err := resolveSecrets(l); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{
+		"TS_API_CLIENT_SECRET": "tskey-client-s3cret",
+		"STORAGE_SMB_PASSWORD": "pa$$word",
+		"STORAGE_SMB_USER":     "pa$$word",
+		"TAILNET_DOMAIN":       "example.ts.net",
+	}
+	for k, w := range want {
+		if got := l.vars[k]; got != w {
+			t.Errorf("%s = %q, want %q", k, got, w)
+		}
+	}
+
+	data, err := os.ReadFile(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got resolveRequest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("request %q: %v", data, err)
+	}
+	if got.Version != 1 || strings.Join(got.Refs, ",") != "ops/smb,ops/tailscale" {
+		t.Errorf("request = %+v, want version 1 and each ref once", got)
+	}
+}
+
+func TestResolveSecretsErrors(t *testing.T) {
+	const value = "tskey-client-s3cret"
+	tests := []struct {
+		name, resolver, want string
+	}{
+		{"ref error", `echo '{"values": {"ops/smb": "` + value + `"}, "errors": {"ops/tailscale": "item not found"}}'`,
+			"TS_API_CLIENT_SECRET: secret:ops/tailscale: item not found"},
+		{"missing value", `echo '{"values": {"ops/smb": "` + value + `"}}'`,
+			"TS_API_CLIENT_SECRET: the secret resolver returned no value for secret:ops/tailscale"},
+		{"exit status", "echo 'vault is locked' >&2; exit 3", "exit status 3\nvault is locked"},
+		{"bad output", `echo '` + value + `'`, "output is not a JSON response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFakeResolver(t, tt.resolver)
+			l := secretLayers(t, "TS_API_CLIENT_SECRET=secret:ops/tailscale\nSTORAGE_SMB_PASSWORD=secret:ops/smb\n")
+			err := resolveSecrets(l)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.want)
+			}
+			if strings.Contains(err.Error(), value) {
+				t.Errorf("error %q contains the secret value", err)
+			}
+		})
+	}
+
+	t.Run("no resolver", func(t *testing.T) {
+		t.Setenv(secretResolverEnv, "")
+		l := secretLayers(t, "TS_API_CLIENT_SECRET=secret:ops/tailscale\n")
+		if err := resolveSecrets(l); err == nil || !strings.Contains(err.Error(), secretResolverEnv+" is not set") {
+			t.Errorf("error = %v, want %s is not set", err, secretResolverEnv)
+		}
+	})
+}
+
+func TestParseEnvSecretRefs(t *testing.T) {
+	dir := t.TempDir()
+	common := writeFile(t, filepath.Join(dir, "common.env"), "TS_API_CLIENT_SECRET=secret:ops/tailscale\nSTORAGE_SMB_PASSWORD=secret:ops/smb\n")
+	site := writeFile(t, filepath.Join(dir, "site.env"), "STORAGE_SMB_PASSWORD=plain\nSTORAGE_SMB_USER='secret:literal'\n")
+	l, err := siteLayers(t, common, site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.secret; len(got) != 1 || got["TS_API_CLIENT_SECRET"] != "ops/tailscale" {
+		t.Errorf("secret = %v, want only TS_API_CLIENT_SECRET, since site.env overrides the other", got)
+	}
+	if got := l.vars["STORAGE_SMB_USER"]; got != "secret:literal" {
+		t.Errorf("quoted STORAGE_SMB_USER = %q, want it literal", got)
+	}
+
+	tests := []struct {
+		input, want string
+	}{
+		{"OVERLAYS=secret:ops/overlays\n", "OVERLAYS: is a list variable; only string variables can be secret: references"},
+		{"TS_API_CLIENT_SECRET=secret:\n", "TS_API_CLIENT_SECRET: secret: needs a reference"},
+		{"TS_API_CLIENT_SECRET=secret:ops/tailscale\nTAILNET_DOMAIN=${TS_API_CLIENT_SECRET}\n",
+			"line 2: TAILNET_DOMAIN: ${TS_API_CLIENT_SECRET} is a secret: reference"},
+	}
+	for _, tt := range tests {
+		_, _, err := parseEnvLayer("site.env", tt.input, testAllowed(t), nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("input %q: got %v, want %q", tt.input, err, tt.want)
+		}
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	withFakeResolver(t, `echo '{"values": {"ops/tailscale": "tskey-client-s3cret", "ops/key": "s3cret"}}'`)
+	l := secretLayers(t, "TS_API_CLIENT_SECRET=secret:ops/tailscale\nSTORAGE_SMB_PASSWORD=secret:ops/key\nTAILNET_DOMAIN=example.ts.net\n")
+	if err := resolveSecrets(l); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := l.secretValues()
+	if got, want := r.redact("oauth tskey-client-s3cret, password s3cret on example.ts.net"),
+		"oauth <redacted>, password <redacted> on example.ts.net"; got != want {
+		t.Errorf("redact = %q, want %q", got, want)
+	}
+
+	plain := fmt.Errorf("processing tailpod.bu: %w", os.ErrNotExist)
+	if got := r.redactErr(plain); got != plain {
+		t.Errorf("redactErr changed an error without secrets: %v", got)
+	}
+	if got := r.redactErr(errors.New("butane: invalid value s3cret")); got.Error() != "butane: invalid value <redacted>" {
+		t.Errorf("redactErr = %v", got)
+	}
+}
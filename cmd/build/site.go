@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sitesDir holds one subdirectory per host when building several sites.
+// outDir receives their Ignition configs.
+const (
+	sitesDir = "sites"
+	outDir   = "out"
+)
+
+// site is one host configuration: a directory holding site.env, deploy_key
+// and optionally site-specific overlays such as server.bu. Its site.env is
+// layered over the shared common.env, if there is one.
+type site struct {
+	name    string // empty for the single-site layout in the working directory
+	dir     string
+	secrets redactor // resolved secret: values, set once site.env is read
+}
+
+// buildOptions are the settings shared by every site in a run.
+type buildOptions struct {
+	arch     string         // -arch flag; overrides TAILPOD_ARCH when set
+	build    string         // TAILPOD_BUILD value (git commit)
+	showEnv  bool           // print which env file each variable came from
+	explain  string         // provenance report format ("text" or "json"); empty for none
+	report   *explainReport // collects --explain=json output; nil otherwise
+	overlays []string       // --overlay selection; nil unless the flag was given
+	without  []string       // --without
+	strict   bool           // --strict: site variable warnings are errors
+	common   *envInput      // common.env, read once for all sites; nil if absent
+}
+
+// status returns where progress and summaries go: stdout, unless stdout
+// carries the --explain=json document.
+func (o buildOptions) status() io.Writer {
+	if o.report != nil {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// prefix labels output lines so parallel site builds can be told apart.
+func (s site) prefix() string {
+	if s.name == "" {
+		return ""
+	}
+	return "[" + s.name + "] "
+}
+
+// report prints warnings about a site's variables, or under --strict fails
+// with them.
+func (s site) report(warnings []string, opts buildOptions) error {
+	if opts.strict && len(warnings) > 0 {
+		return fmt.Errorf("%s\n(these are errors under --strict)", strings.Join(warnings, "\n"))
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s%s\n", s.prefix(), s.secrets.redact(w))
+	}
+	return nil
+}
+
+// overlayDirs returns the directories overlays are discovered in. A site's
+// own .bu files override the shared ones of the same name.
+func (s site) overlayDirs() []string {
+	if s.name == "" {
+		return []string{overlaysDir}
+	}
+	return []string{overlaysDir, s.dir}
+}
+
+// output returns the Ignition file name for one architecture. archSpecified
+// selects per-architecture names (tailpod-arm64.ign) over the default.
+func (s site) output(arch string, archSpecified bool) string {
+	base := "tailpod"
+	if s.name != "" {
+		base = filepath.Join(outDir, s.name)
+	}
+	if archSpecified {
+		return base + "-" + arch + ".ign"
+	}
+	return base + ".ign"
+}
+
+// discoverSites lists the subdirectories of dir that contain a site.env or
+// site.env.enc.
+// A non-empty filter restricts the result to the given comma-separated names.
+func discoverSites(dir, filter string) ([]site, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]site)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		if _, err := (site{dir: p}).envFile(); os.IsNotExist(err) {
+			continue
+		}
+		found[e.Name()] = site{name: e.Name(), dir: p}
+	}
+
+	var sites []site
+	if filter == "" {
+		for _, s := range found {
+			sites = append(sites, s)
+		}
+		sort.Slice(sites, func(i, j int) bool { return sites[i].name < sites[j].name })
+	} else {
+		for _, name := range strings.Split(filter, ",") {
+			name = strings.TrimSpace(name)
+			s, ok := found[name]
+			if !ok {
+				return nil, fmt.Errorf("site %q: no %s or %s", name, filepath.Join(dir, name, "site.env"), encryptedEnv)
+			}
+			sites = append(sites, s)
+		}
+	}
+	if len(sites) == 0 {
+		return nil, fmt.Errorf("%s/: no site directories with a site.env or %s", dir, encryptedEnv)
+	}
+	return sites, nil
+}
+
+// buildSite builds every configured architecture of one site and returns the
+// Ignition files it wrote.
+func buildSite(s site, opts buildOptions) (outputs []string, err error) {
+	defer func() { err = s.secrets.redactErr(err) }()
+
+	envPath, err := s.envFile()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if s.name == "" {
+			return nil, fmt.Errorf("site.env: %w\nCopy site.env.example to site.env and fill in your values.", err)
+		}
+		return nil, fmt.Errorf("%s: %w", envPath, err)
+	}
+
+	keyPath := filepath.Join(s.dir, "deploy_key")
+	if _, err := os.Stat(keyPath); err != nil {
+		return nil, fmt.Errorf("%s: %w\nPlace your SSH deploy key at %s.", keyPath, err, keyPath)
+	}
+
+	overlays, err := discoverOverlays(s.overlayDirs()...)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := overlayTemplates(overlaysDir)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := allowedVars(append(templates, overlays...))
+	if err != nil {
+		return nil, err
+	}
+	layers, err := siteEnvLayers(opts.common, envPath, allowed)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(layers); err != nil {
+		return nil, err
+	}
+	s.secrets = layers.secretValues()
+	vars := layers.vars
+
+	if opts.showEnv {
+		var buf bytes.Buffer
+		if s.name != "" {
+			fmt.Fprintf(&buf, "Site %s:\n", s.name)
+		}
+		layers.writeReport(&buf)
+		opts.status().Write(buf.Bytes())
+	}
+
+	// Check all required variables are present
+	for key := range requiredVars {
+		if _, ok := vars[key]; !ok {
+			return nil, fmt.Errorf("%s: missing required variable %q", strings.Join(layers.files, ", "), key)
+		}
+	}
+	if err := checkValues(vars, layers.source, allowed); err != nil {
+		return nil, err
+	}
+
+	selection, source := opts.overlays, "--overlay"
+	if selection == nil {
+		if v, ok := vars["OVERLAYS"]; ok {
+			selection, source = splitList(v), "OVERLAYS in "+layers.source["OVERLAYS"]
+		}
+	}
+	overlays, skipped, err := selectOverlays(overlays, s.overlayDirs(), selection, source, opts.without)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range skipped {
+		fmt.Fprintf(os.Stderr, "Note: %s%s is present but not selected\n", s.prefix(), o.path)
+	}
+
+	// Each .bu file only sees the variables it declares
+	if err := checkScopes(overlays, allowed); err != nil {
+		return nil, err
+	}
+	var warnings []string
+	for _, o := range overlays {
+		for _, key := range o.required {
+			if _, ok := vars[key]; !ok {
+				warnings = append(warnings, fmt.Sprintf("%s is selected but site.env is missing variable %q", o.path, key))
+			}
+		}
+	}
+	for _, k := range unusedVars(vars, overlays) {
+		warnings = append(warnings, fmt.Sprintf("%s sets %s, which no selected overlay uses", layers.source[k], k))
+	}
+	if err := s.report(warnings, opts); err != nil {
+		return nil, err
+	}
+
+	// Without an explicit architecture, keep building the single tailpod.ign.
+	archSpec := opts.arch
+	if archSpec == "" {
+		archSpec = vars["TAILPOD_ARCH"]
+	}
+	archs := []string{defaultArch}
+	if archSpec != "" {
+		if archs, err = parseArchList(archSpec); err != nil {
+			return nil, err
+		}
+	}
+
+	vars["TAILPOD_BUILD"] = opts.build
+
+	if s.name != "" {
+		if err := os.MkdirAll(outDir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, arch := range archs {
+		output := s.output(arch, archSpec != "")
+		if err := buildArch(s, overlays, vars, allowed, arch, output, opts); err != nil {
+			return outputs, fmt.Errorf("%s: %w", arch, err)
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// siteResult is the outcome of building one site.
+type siteResult struct {
+	outputs []string
+	err     error
+}
+
+// buildSites builds all sites in parallel and prints a per-site summary.
+// It fails if any site failed.
+func buildSites(sites []site, opts buildOptions) error {
+	results := make([]siteResult, len(sites))
+	var wg sync.WaitGroup
+	for i, s := range sites {
+		wg.Add(1)
+		go func(i int, s site) {
+			defer wg.Done()
+			outputs, err := buildSite(s, opts)
+			results[i] = siteResult{outputs: outputs, err: err}
+		}(i, s)
+	}
+	wg.Wait()
+
+	out := opts.status()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Summary:")
+	failed := 0
+	for i, s := range sites {
+		r := results[i]
+		if r.err != nil {
+			failed++
+			fmt.Fprintf(out, "  FAIL %s: %v\n", s.name, r.err)
+			continue
+		}
+		fmt.Fprintf(out, "  ok   %s: %s\n", s.name, strings.Join(r.outputs, ", "))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sites failed", failed, len(sites))
+	}
+	return nil
+}
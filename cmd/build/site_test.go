@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSite creates dir/<name>/site.env (and deploy_key) for discovery tests.
+func writeSite(t *testing.T, dir, name string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(p, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(p, "site.env"), []byte(validEnv()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(p, "deploy_key"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// withWorkspace puts a stand-in butane on PATH and changes to a new
+// workspace with a minimal tailpod.bu and the named sites, each with a
+// site.env that passes checkValues. It returns the workspace.
+func withWorkspace(t *testing.T, sites ...string) string {
+	t.Helper()
+	bin := t.TempDir()
+	writeFile(t, filepath.Join(bin, "butane"), "#!/bin/sh\ncat >/dev/null\necho '{\"ignition\": {\"version\": \"3.4.0\"}}'\n")
+	if err := os.Chmod(filepath.Join(bin, "butane"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "tailpod.bu"), "variant: fcos\nversion: 1.5.0\n")
+	if err := os.Mkdir(filepath.Join(dir, overlaysDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range sites {
+		p := writeSite(t, filepath.Join(dir, sitesDir), name)
+		writeFile(t, filepath.Join(p, "site.env"), "SSH_PUBKEY="+testSSHKey("ssh-ed25519")+"\nQUADSYNC_GIT_URL=git@github.com:org/containers.git\nQUADSYNC_GIT_BRANCH=main\n")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func TestDiscoverSites(t *testing.T) {
+	dir := t.TempDir()
+	writeSite(t, dir, "beta")
+	writeSite(t, dir, "alpha")
+	// Directories without site.env are not sites
+	if err := os.MkdirAll(filepath.Join(dir, "notes"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	sites, err := discoverSites(dir, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sites) != 2 || sites[0].name != "alpha" || sites[1].name != "beta" {
+		t.Errorf("got %+v, want alpha and beta in order", sites)
+	}
+	if sites[0].dir != filepath.Join(dir, "alpha") {
+		t.Errorf("dir = %q", sites[0].dir)
+	}
+}
+
+func TestDiscoverSitesFilter(t *testing.T) {
+	dir := t.TempDir()
+	writeSite(t, dir, "alpha")
+	writeSite(t, dir, "beta")
+
+	sites, err := discoverSites(dir, "beta")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sites) != 1 || sites[0].name != "beta" {
+		t.Errorf("got %+v, want only beta", sites)
+	}
+
+	_, err = discoverSites(dir, "gamma")
+	if err == nil || !strings.Contains(err.Error(), "gamma") {
+		t.Errorf("expected error naming gamma, got %v", err)
+	}
+}
+
+func TestDiscoverSitesEmpty(t *testing.T) {
+	if _, err := discoverSites(t.TempDir(), ""); err == nil {
+		t.Error("expected error for empty sites directory")
+	}
+}
+
+func TestSiteOutput(t *testing.T) {
+	tests := []struct {
+		s             site
+		arch          string
+		archSpecified bool
+		want          string
+	}{
+		{site{dir: "."}, "arm64", false, "tailpod.ign"},
+		{site{dir: "."}, "amd64", true, "tailpod-amd64.ign"},
+		{site{name: "alpha", dir: "sites/alpha"}, "arm64", false, filepath.Join("out", "alpha.ign")},
+		{site{name: "alpha", dir: "sites/alpha"}, "arm64", true, filepath.Join("out", "alpha-arm64.ign")},
+	}
+	for _, tt := range tests {
+		if got := tt.s.output(tt.arch, tt.archSpecified); got != tt.want {
+			t.Errorf("output(%q, %v) for %q = %q, want %q", tt.arch, tt.archSpecified, tt.s.name, got, tt.want)
+		}
+	}
+}
+
+func TestSiteOverlayDirs(t *testing.T) {
+	if got := strings.Join(site{dir: "."}.overlayDirs(), " "); got != "overlays" {
+		t.Errorf("single site: got %s, want overlays", got)
+	}
+	s := site{name: "alpha", dir: filepath.Join("sites", "alpha")}
+	if got, want := strings.Join(s.overlayDirs(), " "), "overlays "+s.dir; got != want {
+		t.Errorf("named site: got %s, want %s", got, want)
+	}
+}
+
+func TestBuildSitesReportsFailures(t *testing.T) {
+	dir := t.TempDir()
+	p := writeSite(t, dir, "broken")
+	if err := os.Remove(filepath.Join(p, "deploy_key")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := buildSites([]site{{name: "broken", dir: p}}, buildOptions{build: "test"})
+	if err == nil || !strings.Contains(err.Error(), "1 of 1 sites failed") {
+		t.Errorf("expected summary failure, got %v", err)
+	}
+}
+
+func TestSiteReportStrict(t *testing.T) {
+	s := site{name: "alpha"}
+	warnings := []string{"sites/alpha/site.env sets STORAGE_SMB_HOST, which no selected overlay uses"}
+	if err := s.report(nil, buildOptions{strict: true}); err != nil {
+		t.Errorf("no warnings: unexpected error %v", err)
+	}
+	err := s.report(warnings, buildOptions{strict: true})
+	if err == nil || !strings.Contains(err.Error(), warnings[0]) || !strings.Contains(err.Error(), "--strict") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
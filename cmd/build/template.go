@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// varRef matches a ${VAR} expression on an upper-case variable name, or its
+// escaped form $${VAR}. The expression may carry a default, ${VAR:-text}, or
+// a required marker, ${VAR:?message}, and then an escaping filter,
+// ${VAR|yaml} (see filters). A default can't contain | or }.
+var varRef = regexp.MustCompile(`\$?\$\{([A-Z_][A-Z0-9_]*)(?::([-?])([^}|]*))?(\|[^}]*)?\}`)
+
+// directive matches a conditional block line: "# @if VAR", "# @if !VAR",
+// "# @else" or "# @end", indented like the YAML around it.
+var directive = regexp.MustCompile(`^\s*#\s*@(if|else|end)\b\s*(.*?)\s*$`)
+
+// escapedDirective matches a line that looks like a directive but doubles
+// the @, "# @@if ...", which renders with one @ fewer: "# @if ...".
+var escapedDirective = regexp.MustCompile(`^(\s*#\s*@)@(@*(?:if|else|end))\b`)
+
+// literalHint follows each error about a malformed directive, since such a
+// line can be a comment in a file's contents rather than a directive.
+const literalHint = `(write "# @@" for a literal "# @" line)`
+
+// substitute expands ${...} expressions whose variable is in vars in a single
+// pass, so a value containing ${OTHER} is never expanded again. A variable
+// in vars that is empty takes the default of ${VAR:-default}, and the value
+// then goes through the expression's filter, if any. $${VAR} is an escape
+// that renders as a literal ${VAR}. Bare $VAR, $(...), shell forms such as
+// ${1-}, and expressions that can't be resolved or filtered are left
+// untouched (render reports the latter).
+func substitute(content string, vars map[string]string) string {
+	return varRef.ReplaceAllStringFunc(content, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+		m := varRef.FindStringSubmatch(ref)
+		v, ok := resolve(m, vars)
+		if !ok {
+			return ref
+		}
+		if m[4] != "" {
+			f, err := applyFilter(m[4][1:], v)
+			if err != nil {
+				return ref
+			}
+			v = f
+		}
+		return v
+	})
+}
+
+// resolve returns the unfiltered value of the varRef match m, and whether
+// it has one: a ${VAR:?message} whose variable is empty has none. Defaults
+// and required markers only apply to variables declared in vars, so a typo
+// or a shell variable such as ${HOME:-/root} stays unresolved.
+func resolve(m []string, vars map[string]string) (string, bool) {
+	v, ok := vars[m[1]]
+	switch {
+	case !ok:
+		return "", false
+	case m[2] == "-" && v == "":
+		return m[3], true
+	case m[2] == "?" && v == "":
+		return "", false
+	}
+	return v, ok
+}
+
+// render expands a .bu file for butane. Lines between "# @if VAR" and
+// "# @end" are kept only when VAR is set to a non-empty value, or to true for
+// a bool ("# @if !VAR" inverts the test, and "# @else" starts the
+// alternative); the directive lines themselves are dropped. Blocks nest.
+// Directives apply anywhere in the file, including inside a block scalar's
+// contents, so a file line that starts "# @if", "# @else" or "# @end" is
+// written with a doubled @ ("# @@end") and rendered with one @ fewer. Kept
+// lines are then expanded with listLines and substitute, using types to find
+// list variables. Every ${VAR} that is still unresolved, every ${VAR:?message}
+// whose variable is unset or empty, and every malformed block is reported
+// with its line number, as is a filter that fails or doesn't exist.
+//
+// render also returns a warning for each unfiltered value that isn't safe in
+// the text it lands in (see textContext), naming the filter that would fix
+// it. Neither errors nor warnings quote the value, which may be a secret.
+func render(name, content string, vars map[string]string, types map[string]varType) (string, []string, error) {
+	type block struct {
+		line         int
+		keep, inElse bool
+		parentKeep   bool
+	}
+	var (
+		out      []string
+		errs     []error
+		warnings []string
+		stack    []block
+		context  contextTracker
+	)
+	keep := true
+	for i, line := range strings.Split(content, "\n") {
+		n := i + 1
+		if m := directive.FindStringSubmatch(line); m != nil {
+			switch m[1] {
+			case "if":
+				cond, negate := strings.CutPrefix(m[2], "!")
+				if !envVarName.MatchString(cond) {
+					errs = append(errs, fmt.Errorf("%s line %d: @if needs a variable name, got %q %s", name, n, m[2], literalHint))
+				} else if _, ok := vars[cond]; !ok {
+					errs = append(errs, fmt.Errorf("%s line %d: @if %s: variable is not declared for this file %s", name, n, cond, literalHint))
+				}
+				set := typeOf(types, cond).isSet(vars[cond])
+				stack = append(stack, block{line: n, keep: set != negate, parentKeep: keep})
+				keep = keep && set != negate
+			case "else":
+				if m[2] != "" {
+					errs = append(errs, fmt.Errorf("%s line %d: @else takes nothing after it, got %q %s", name, n, m[2], literalHint))
+				}
+				if len(stack) == 0 || stack[len(stack)-1].inElse {
+					errs = append(errs, fmt.Errorf("%s line %d: @else without @if %s", name, n, literalHint))
+					continue
+				}
+				b := &stack[len(stack)-1]
+				b.inElse = true
+				keep = b.parentKeep && !b.keep
+			case "end":
+				if m[2] != "" {
+					errs = append(errs, fmt.Errorf("%s line %d: @end takes nothing after it, got %q %s", name, n, m[2], literalHint))
+				}
+				if len(stack) == 0 {
+					errs = append(errs, fmt.Errorf("%s line %d: @end without @if %s", name, n, literalHint))
+					continue
+				}
+				keep = stack[len(stack)-1].parentKeep
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		if !keep {
+			continue
+		}
+		line = escapedDirective.ReplaceAllString(line, "$1$2")
+		kind := context.next(line)
+		lines, lineVars, err := listLines(line, kind, vars, types)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s line %d: %w", name, n, err))
+			continue
+		}
+		for j, line := range lines {
+			vars := lineVars[j]
+			for _, m := range varRef.FindAllStringSubmatch(line, -1) {
+				if strings.HasPrefix(m[0], "$$") {
+					continue
+				}
+				_, declared := vars[m[1]]
+				v, ok := resolve(m, vars)
+				switch {
+				case m[2] == "?" && declared && !ok:
+					msg := m[3]
+					if msg == "" {
+						msg = "must be set in site.env"
+					}
+					errs = append(errs, fmt.Errorf("%s line %d: %s: %s", name, n, m[1], msg))
+				case !ok:
+					errs = append(errs, fmt.Errorf("%s line %d: unresolved ${%s} (set it in site.env, or write $${%s} for a literal)", name, n, m[1], m[1]))
+				case m[4] != "":
+					if _, err := applyFilter(m[4][1:], v); err != nil {
+						errs = append(errs, fmt.Errorf("%s line %d: ${%s%s}: %w", name, n, m[1], m[4], err))
+					}
+				default:
+					if reason, filter := kind.unescaped(v); reason != "" {
+						w := fmt.Sprintf("%s line %d: ${%s} %s", name, n, m[1], reason)
+						if filter != "" {
+							w += fmt.Sprintf("; write ${%s|%s}", m[1], filter)
+						}
+						// Items of a list share a line; warn once.
+						if len(warnings) == 0 || warnings[len(warnings)-1] != w {
+							warnings = append(warnings, w)
+						}
+					}
+				}
+			}
+			out = append(out, substitute(line, vars))
+		}
+	}
+	for _, b := range stack {
+		errs = append(errs, fmt.Errorf("%s line %d: @if without @end", name, b.line))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return "", nil, err
+	}
+	return strings.Join(out, "\n"), warnings, nil
+}
+
+// sequenceEntry matches a YAML sequence entry line, "- value".
+var sequenceEntry = regexp.MustCompile(`^\s*- `)
+
+// listLines expands the list variable that line references, if any. In a
+// YAML value (key: ${LIST}) the reference becomes a flow sequence of quoted
+// items. Anywhere else, such as a sequence entry (- ${LIST}) or a line of a
+// file, the line is repeated once per item, and each copy is rendered with
+// the variable set to that item; an empty list drops the line. It returns
+// the lines and the variables to render each with.
+func listLines(line string, kind textContext, vars map[string]string, types map[string]varType) ([]string, []map[string]string, error) {
+	var list []string // the varRef match of the list variable
+	for _, m := range varRef.FindAllStringSubmatch(line, -1) {
+		if strings.HasPrefix(m[0], "$$") || types[m[1]] != typeList {
+			continue
+		}
+		if list != nil {
+			return nil, nil, fmt.Errorf("${%s} and ${%s} are both lists; put each on its own line", list[1], m[1])
+		}
+		list = m
+	}
+	if list == nil {
+		return []string{line}, []map[string]string{vars}, nil
+	}
+	v, ok := resolve(list, vars)
+	if !ok {
+		// render reports it.
+		return []string{line}, []map[string]string{vars}, nil
+	}
+	items := splitList(v)
+
+	if kind == contextYAML && !sequenceEntry.MatchString(line) {
+		if list[4] != "" && list[4] != "|yaml" {
+			for i, item := range items {
+				f, err := applyFilter(list[4][1:], item)
+				if err != nil {
+					return nil, nil, fmt.Errorf("${%s%s}: %w", list[1], list[4], err)
+				}
+				items[i] = f
+			}
+		}
+		flow, err := flowSequence(items)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{strings.Replace(line, list[0], flow, 1)}, []map[string]string{vars}, nil
+	}
+
+	lines := make([]string, len(items))
+	lineVars := make([]map[string]string, len(items))
+	for i, item := range items {
+		itemVars := make(map[string]string, len(vars))
+		for k, v := range vars {
+			itemVars[k] = v
+		}
+		itemVars[list[1]] = item
+		lines[i], lineVars[i] = line, itemVars
+	}
+	return lines, lineVars, nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSubstituteEscapeAndSinglePass(t *testing.T) {
+	vars := map[string]string{"TAILNET_DOMAIN": "${SSH_PUBKEY}", "SSH_PUBKEY": "key"}
+	input := "${TAILNET_DOMAIN} $${TAILNET_DOMAIN} ${1-} $$"
+	want := "${SSH_PUBKEY} ${TAILNET_DOMAIN} ${1-} $$"
+	if got := substitute(input, vars); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRenderUnresolved(t *testing.T) {
+	vars := map[string]string{"TAILNET_DOMAIN": "example.ts.net"}
+	input := `dns-search=${TAILNET_DOMAIN}
+search=${TAILNET_DOMIAN}
+if [[ -z "${1-}" ]]; then echo ${name} $HOME; fi
+literal=$${TAILNET_DOMIAN} ${STORAGE_SMB_HOST}`
+
+	_, _, err := render("overlays/tailscale.bu", input, vars, nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		"overlays/tailscale.bu line 2: unresolved ${TAILNET_DOMIAN}",
+		"overlays/tailscale.bu line 4: unresolved ${STORAGE_SMB_HOST}",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if n := strings.Count(err.Error(), "unresolved"); n != 2 {
+		t.Errorf("got %d unresolved references, want 2:\n%v", n, err)
+	}
+
+	if _, _, err := render("tailpod.bu", "key: ${TAILNET_DOMAIN}\nrun: ${1-}\n", vars, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// A default doesn't stand in for a variable the file doesn't declare.
+	input = "search=${TAILNET_DOMIAN:-example.ts.net}\nhome=${HOME:-/root}\n"
+	_, _, err = render("overlays/tailscale.bu", input, vars, nil)
+	for _, want := range []string{
+		"overlays/tailscale.bu line 1: unresolved ${TAILNET_DOMIAN}",
+		"overlays/tailscale.bu line 2: unresolved ${HOME}",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+}
+
+func TestSubstituteDefaults(t *testing.T) {
+	vars := map[string]string{"TAILNET_DOMAIN": "example.ts.net", "QUADSYNC_AGE_KEY": "", "STORAGE_SMB_PORT": ""}
+	input := "${TAILNET_DOMAIN:-fallback} ${QUADSYNC_AGE_KEY:-none} ${STORAGE_SMB_PORT:-445} ${TAILNET_DOMAIN:?needed} ${HOME:-/root}"
+	want := "example.ts.net none 445 example.ts.net ${HOME:-/root}"
+	if got := substitute(input, vars); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRenderRequiredMarker(t *testing.T) {
+	vars := map[string]string{"QUADSYNC_AGE_KEY": "", "TAILNET_DOMAIN": ""}
+	input := "a\nkey: ${QUADSYNC_AGE_KEY:?set it to the AGE-SECRET-KEY from age-keygen}\nb: ${TAILNET_DOMAIN:?}\nc: ${STORAGE_SMB_HOST:?}\n"
+	_, _, err := render("tailpod.bu", input, vars, nil)
+	for _, want := range []string{
+		"tailpod.bu line 2: QUADSYNC_AGE_KEY: set it to the AGE-SECRET-KEY from age-keygen",
+		"tailpod.bu line 3: TAILNET_DOMAIN: must be set in site.env",
+		"tailpod.bu line 4: unresolved ${STORAGE_SMB_HOST}",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+}
+
+func TestRenderConditionalBlocks(t *testing.T) {
+	input := `files:
+  # @if QUADSYNC_AGE_KEY
+  - path: /etc/quadsync/age.key
+    contents:
+      inline: ${QUADSYNC_AGE_KEY}
+  # @else
+  - path: /etc/quadsync/no-age-key
+  # @end
+  # @if !QUADSYNC_AGE_KEY
+  # @if TAILNET_DOMAIN
+  - path: /etc/both
+  # @end
+  # @end
+  - path: /etc/always
+`
+	got, _, err := render("tailpod.bu", input, map[string]string{"QUADSYNC_AGE_KEY": "AGE-SECRET-KEY-1", "TAILNET_DOMAIN": "x"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `files:
+  - path: /etc/quadsync/age.key
+    contents:
+      inline: AGE-SECRET-KEY-1
+  - path: /etc/always
+`
+	if got != want {
+		t.Errorf("with key:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Unset: the key block is dropped without complaining about its ${...}
+	got, _, err = render("tailpod.bu", input, map[string]string{"QUADSYNC_AGE_KEY": "", "TAILNET_DOMAIN": "x"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = `files:
+  - path: /etc/quadsync/no-age-key
+  - path: /etc/both
+  - path: /etc/always
+`
+	if got != want {
+		t.Errorf("without key:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRenderEscapedDirectives(t *testing.T) {
+	input := `storage:
+  files:
+    - path: /usr/local/bin/notes
+      contents:
+        inline: |
+          # @@if QUADSYNC_AGE_KEY is set, the key is already on disk
+          # @if QUADSYNC_AGE_KEY
+          echo ${QUADSYNC_AGE_KEY}
+          # @end
+          #@@end of notes
+          # @@@if stays doubled`
+	want := `storage:
+  files:
+    - path: /usr/local/bin/notes
+      contents:
+        inline: |
+          # @if QUADSYNC_AGE_KEY is set, the key is already on disk
+          #@end of notes
+          # @@if stays doubled`
+	got, _, err := render("tailpod.bu", input, map[string]string{"QUADSYNC_AGE_KEY": ""}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRenderMalformedBlocks(t *testing.T) {
+	tests := []struct{ input, want string }{
+		{"# @if QUADSYNC_AGE_KEY\na\n", "line 1: @if without @end"},
+		{"a\n# @end\n", "line 2: @end without @if"},
+		{"# @else\n", "line 1: @else without @if"},
+		{"# @if QUADSYNC_AGE_KEY\n# @else\n# @else\n# @end\n", "line 3: @else without @if"},
+		{"# @if TAILNET_DOMIAN\n# @end\n", "line 1: @if TAILNET_DOMIAN: variable is not declared"},
+		{"# @if\n# @end\n", "line 1: @if needs a variable name"},
+		{"# @if QUADSYNC_AGE_KEY\n# @end of notes\n", `line 2: @end takes nothing after it, got "of notes"`},
+		{"# @if QUADSYNC_AGE_KEY\n# @else if\n# @end\n", `line 2: @else takes nothing after it, got "if"`},
+		{"run: |\n  # @if you want to, edit this\n", `line 2: @if needs a variable name, got "you want to, edit this" (write "# @@" for a literal "# @" line)`},
+	}
+	for _, tt := range tests {
+		_, _, err := render("tailpod.bu", tt.input, map[string]string{"QUADSYNC_AGE_KEY": "k"}, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: expected %q, got %v", tt.input, tt.want, err)
+		}
+	}
+}
+
+func TestRenderRepoFiles(t *testing.T) {
+	bin, err := binaryVars(defaultArch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"TAILPOD_BUILD": "test"}
+	for k := range testAllowed(t) {
+		vars[k] = "value"
+	}
+	vars["QUADSYNC_AGE_KEY"] = ""
+
+	data, err := os.ReadFile(filepath.Join("..", "..", "tailpod.bu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, warnings, err := render("tailpod.bu", string(data), scopeVars(vars, bin, baseScope(), optionalBaseVars), testAllowed(t))
+	if err != nil {
+		t.Fatalf("tailpod.bu: %v", err)
+	}
+	for _, w := range warnings {
+		t.Errorf("unexpected warning: %s", w)
+	}
+	if strings.Contains(out, "age.key") {
+		t.Error("tailpod.bu writes age.key without QUADSYNC_AGE_KEY")
+	}
+
+	dir := filepath.Join("..", "..", overlaysDir)
+	overlays, err := discoverOverlays(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := overlayTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range append(overlays, templates...) {
+		data, err := os.ReadFile(o.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, warnings, err := render(o.path, string(data), scopeVars(vars, bin, o.scope(), o.optional), testAllowed(t))
+		if err != nil {
+			t.Errorf("%s: %v", o.path, err)
+		}
+		for _, w := range warnings {
+			t.Errorf("unexpected warning: %s", w)
+		}
+	}
+}
+
+func TestRenderFilters(t *testing.T) {
+	vars := map[string]string{"STORAGE_SMB_PASSWORD": `p"a:ss #1`, "TAILNET_DOMAIN": "50%", "STORAGE_SMB_USER": ""}
+	input := `password: ${STORAGE_SMB_PASSWORD|yaml}
+encoded: ${STORAGE_SMB_PASSWORD|base64}
+source: "data:,${STORAGE_SMB_PASSWORD|urlpath}"
+user: ${STORAGE_SMB_USER:-nobody|yaml}
+unit: |
+  [Service]
+  Environment=DOMAIN=${TAILNET_DOMAIN|ini}`
+	want := `password: "p\"a:ss #1"
+encoded: cCJhOnNzICMx
+source: "data:,p%22a:ss%20%231"
+user: "nobody"
+unit: |
+  [Service]
+  Environment=DOMAIN=50%%`
+	got, warnings, err := render("overlays/server.bu", input, vars, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %q", warnings)
+	}
+
+	vars["STORAGE_SMB_PASSWORD"] = "line1\nline2"
+	_, _, err = render("overlays/server.bu", "a: ${STORAGE_SMB_PASSWORD|ini}\nb: ${TAILNET_DOMAIN|json}\n", vars, nil)
+	for _, want := range []string{
+		"overlays/server.bu line 1: ${STORAGE_SMB_PASSWORD|ini}: value has a line break",
+		`overlays/server.bu line 2: ${TAILNET_DOMAIN|json}: unknown filter "json"`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "line1") {
+		t.Errorf("error quotes the value: %v", err)
+	}
+}
+
+func TestRenderUnescapedWarnings(t *testing.T) {
+	vars := map[string]string{
+		"SSH_PUBKEY":           "ssh-ed25519 AAAA you@example.com",
+		"TAILPOD_BUILD":        "1234567",
+		"STORAGE_SMB_PASSWORD": "pass: word\nmore",
+		"STORAGE_SMB_USER":     "ops team",
+		"TAILNET_DOMAIN":       "100%",
+	}
+	input := `storage:
+  files:
+    - path: /etc/sudoers.d/storage
+      contents:
+        inline: |
+          ${STORAGE_SMB_USER} ALL=(root) NOPASSWD: /usr/bin/true
+    - path: /etc/samba/credentials
+      contents:
+        inline: |
+          password=${STORAGE_SMB_PASSWORD}
+    - path: /etc/tailpod/build
+      contents:
+        inline: ${TAILPOD_BUILD}
+passwd:
+  users:
+    - name: core
+      ssh_authorized_keys:
+        - ${SSH_PUBKEY}
+systemd:
+  units:
+    - name: foo.service
+      contents: |
+        [Service]
+        Environment=DOMAIN=${TAILNET_DOMAIN}
+        # ${TAILNET_DOMAIN} in a comment is still unit file text
+`
+	_, warnings, err := render("tailpod.bu", input, vars, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"tailpod.bu line 6: ${STORAGE_SMB_USER} is substituted into a sudoers rule, and its value has characters sudoers treats specially; write ${STORAGE_SMB_USER|sudoers}",
+		"tailpod.bu line 10: ${STORAGE_SMB_PASSWORD} has a line break, which ends the YAML block it is substituted into",
+		"tailpod.bu line 13: ${TAILPOD_BUILD} is substituted into a YAML value, and its value needs quoting; write ${TAILPOD_BUILD|yaml}",
+		"tailpod.bu line 24: ${TAILNET_DOMAIN} is substituted into a unit file, and its value has a %, a trailing \\ or a line break; write ${TAILNET_DOMAIN|ini}",
+		"tailpod.bu line 25: ${TAILNET_DOMAIN} is substituted into a unit file, and its value has a %, a trailing \\ or a line break; write ${TAILNET_DOMAIN|ini}",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got warnings:\n%s\nwant:\n%s", strings.Join(warnings, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRenderLists(t *testing.T) {
+	types := map[string]varType{"SSH_PUBKEYS": typeList, "METRICS_ENABLED": typeBool, "DNS_SERVERS": typeList}
+	vars := map[string]string{
+		"SSH_PUBKEY":      "ssh-ed25519 AAAA core",
+		"SSH_PUBKEYS":     "ssh-ed25519 BBBB alice, ssh-ed25519 CCCC bob: on-call",
+		"DNS_SERVERS":     "1.1.1.1,${SSH_PUBKEY}",
+		"METRICS_ENABLED": "false",
+	}
+	input := `users:
+  - name: core
+    ssh_authorized_keys:
+      - ${SSH_PUBKEY|yaml}
+      - ${SSH_PUBKEYS|yaml}
+dns: ${DNS_SERVERS}
+files:
+  - path: /etc/resolv.conf
+    contents:
+      inline: |
+        nameserver ${DNS_SERVERS}
+# @if METRICS_ENABLED
+metrics: on
+# @end`
+	want := `users:
+  - name: core
+    ssh_authorized_keys:
+      - "ssh-ed25519 AAAA core"
+      - "ssh-ed25519 BBBB alice"
+      - "ssh-ed25519 CCCC bob: on-call"
+dns: ["1.1.1.1", "\u0024{SSH_PUBKEY}"]
+files:
+  - path: /etc/resolv.conf
+    contents:
+      inline: |
+        nameserver 1.1.1.1
+        nameserver ${SSH_PUBKEY}`
+	got, _, err := render("tailpod.bu", input, vars, types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	vars["SSH_PUBKEYS"] = ""
+	got, _, err = render("tailpod.bu", "keys:\n  - a\n  - ${SSH_PUBKEYS|yaml}\nflow: ${SSH_PUBKEYS}", vars, types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "keys:\n  - a\nflow: []"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, _, err = render("tailpod.bu", "x: ${SSH_PUBKEYS} ${DNS_SERVERS}", vars, types)
+	if err == nil || !strings.Contains(err.Error(), "tailpod.bu line 1: ${SSH_PUBKEYS} and ${DNS_SERVERS} are both lists") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// supportedIgnitionVersions are the config spec versions Fedora CoreOS's
+// Ignition accepts.
+var supportedIgnitionVersions = map[string]bool{
+	"3.0.0": true,
+	"3.1.0": true,
+	"3.2.0": true,
+	"3.3.0": true,
+	"3.4.0": true,
+	"3.5.0": true,
+}
+
+// unitSuffixes are the systemd unit types Ignition can write.
+var unitSuffixes = []string{
+	".service", ".socket", ".device", ".mount", ".automount", ".swap",
+	".target", ".path", ".timer", ".slice", ".scope",
+}
+
+// accountName matches user and group names useradd/groupadd accept with
+// their default NAME_REGEX.
+var accountName = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,30}\$?$`)
+
+// problem is one validation failure, attributed to the .bu files that
+// contributed the offending entry.
+type problem struct {
+	sources []string
+	msg     string
+}
+
+// validationError lists every problem found in a merged config.
+type validationError []problem
+
+func (e validationError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "merged ignition config is invalid (%d problems):", len(e))
+	for _, p := range e {
+		src := "merged config"
+		if len(p.sources) > 0 {
+			src = strings.Join(p.sources, ", ")
+		}
+		fmt.Fprintf(&sb, "\n  %s: %s", src, p.msg)
+	}
+	return sb.String()
+}
+
+// sourceIndex maps an entry key such as "storage.files /etc/x" or
+// "systemd.units foo.service" to the parts that define it, in merge order.
+type sourceIndex map[string][]string
+
+func entryKey(section, field, key string) string {
+	return section + "." + field + " " + key
+}
+
+// indexSources parses each part and records which entries it defines.
+func indexSources(parts []ignPart) (sourceIndex, []map[string]any, error) {
+	idx := make(sourceIndex)
+	docs := make([]map[string]any, len(parts))
+	for i, p := range parts {
+		if err := json.Unmarshal(p.ign, &docs[i]); err != nil {
+			return nil, nil, fmt.Errorf("parsing %s ignition: %w", p.name, err)
+		}
+		for _, f := range keyedFields {
+			for _, m := range ignEntries(docs[i], f.section, f.field) {
+				k, _ := m[f.key].(string)
+				key := entryKey(f.section, f.field, k)
+				if srcs := idx[key]; len(srcs) == 0 || srcs[len(srcs)-1] != p.name {
+					idx[key] = append(srcs, p.name)
+				}
+			}
+		}
+	}
+	return idx, docs, nil
+}
+
+// keyedFields are the Ignition arrays whose entries are identified by a key.
+var keyedFields = []struct{ section, field, key string }{
+	{"storage", "files", "path"},
+	{"storage", "directories", "path"},
+	{"storage", "links", "path"},
+	{"storage", "disks", "device"},
+	{"storage", "filesystems", "device"},
+	{"storage", "luks", "name"},
+	{"storage", "raid", "name"},
+	{"systemd", "units", "name"},
+	{"passwd", "users", "name"},
+	{"passwd", "groups", "name"},
+}
+
+// validateIgnition checks a merged config for problems Ignition would only
+// report at first boot: unsupported versions, bad or duplicate paths, invalid
+// modes, unknown unit types, masked-but-enabled units and invalid account
+// names. Every problem is reported, each with the parts that introduced it.
+func validateIgnition(merged map[string]any, parts []ignPart) error {
+	idx, docs, err := indexSources(parts)
+	if err != nil {
+		return err
+	}
+	var problems validationError
+	report := func(sources []string, format string, args ...any) {
+		problems = append(problems, problem{sources: sources, msg: fmt.Sprintf(format, args...)})
+	}
+
+	// ignition.version
+	version := ignitionVersion(merged)
+	if !supportedIgnitionVersions[version] {
+		report(nil, "unsupported ignition.version %q", version)
+	}
+	for i, doc := range docs {
+		if v := ignitionVersion(doc); v != version {
+			report([]string{parts[i].name}, "ignition.version %q differs from merged version %q", v, version)
+		}
+	}
+
+	// storage paths: absolute, clean, unique across files, directories and links
+	pathKind := make(map[string]string)
+	for _, field := range []string{"files", "directories", "links"} {
+		for _, m := range ignEntries(merged, "storage", field) {
+			p, _ := m["path"].(string)
+			key := entryKey("storage", field, p)
+			switch {
+			case p == "":
+				report(idx[key], "storage.%s entry has no path", field)
+				continue
+			case !path.IsAbs(p):
+				report(idx[key], "%s: path is not absolute", key)
+			case path.Clean(p) != p:
+				report(idx[key], "%s: path is not clean (want %s)", key, path.Clean(p))
+			}
+			if prev, dup := pathKind[p]; dup {
+				srcs := mergeSources(idx[entryKey("storage", prev, p)], idx[key])
+				if prev == field {
+					report(srcs, "%s: declared more than once", key)
+				} else {
+					report(srcs, "%s: also declared in storage.%s", key, prev)
+				}
+			} else {
+				pathKind[p] = field
+			}
+			if msg := checkMode(m["mode"]); msg != "" {
+				report(idx[key], "%s: %s", key, msg)
+			}
+		}
+	}
+
+	// systemd units: known types, drop-in names, mask/enabled consistency
+	for _, m := range ignEntries(merged, "systemd", "units") {
+		name, _ := m["name"].(string)
+		key := entryKey("systemd", "units", name)
+		if !validUnitName(name) {
+			report(idx[key], "%s: not a valid unit name (want one of %s)", key, strings.Join(unitSuffixes, " "))
+		}
+		for _, d := range asSlice(m["dropins"]) {
+			dm, _ := d.(map[string]any)
+			dn, _ := dm["name"].(string)
+			if !strings.HasSuffix(dn, ".conf") || strings.ContainsRune(dn, '/') {
+				report(idx[key], "%s: drop-in %q must be a .conf file name", key, dn)
+			}
+		}
+		if mask, _ := m["mask"].(bool); mask {
+			if enabled, _ := m["enabled"].(bool); enabled {
+				report(idx[key], "%s: both masked and enabled", key)
+			}
+		}
+	}
+
+	// passwd users and groups
+	for _, field := range []string{"users", "groups"} {
+		for _, m := range ignEntries(merged, "passwd", field) {
+			name, _ := m["name"].(string)
+			if !accountName.MatchString(name) {
+				report(idx[entryKey("passwd", field, name)], "passwd.%s %q: invalid name", field, name)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func ignitionVersion(doc map[string]any) string {
+	ign, _ := doc["ignition"].(map[string]any)
+	v, _ := ign["version"].(string)
+	return v
+}
+
+// checkMode returns a description of what's wrong with a mode, or "".
+func checkMode(v any) string {
+	if v == nil {
+		return ""
+	}
+	mode, ok := v.(float64)
+	if !ok || mode != math.Trunc(mode) {
+		return fmt.Sprintf("mode %v is not an integer", v)
+	}
+	if mode < 0 || mode > 0o7777 {
+		return fmt.Sprintf("mode %v is outside 0000-7777 (octal)", v)
+	}
+	return ""
+}
+
+func validUnitName(name string) bool {
+	if strings.ContainsRune(name, '/') {
+		return false
+	}
+	for _, suffix := range unitSuffixes {
+		if len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeSources concatenates source lists, dropping repeats.
+func mergeSources(lists ...[]string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, l := range lists {
+		for _, s := range l {
+			if !seen[s] {
+				seen[s] = true
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// mergedDoc merges parts the way buildArch does, for validation tests.
+func mergedDoc(t *testing.T, parts []ignPart) map[string]any {
+	t.Helper()
+	m, err := mergeParts(parts)
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	return m.doc
+}
+
+func TestValidateIgnitionValid(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"ignition": {"version": "3.5.0"},
+  "storage": {"directories": [{"path": "/etc/quadsync"}],
+    "files": [{"path": "/etc/quadsync/transforms/_base.container", "mode": 420, "contents": {"source": "data:,a"}}]},
+  "systemd": {"units": [{"name": "quadsync-sync.timer", "enabled": true}]},
+  "passwd": {"users": [{"name": "core"}], "groups": [{"name": "cusers"}]}}`)},
+		{name: "server.bu", ign: []byte(`{"ignition": {"version": "3.5.0"},
+  "storage": {"directories": [{"path": "/etc/samba"}],
+    "files": [{"path": "/etc/quadsync/transforms/_base.container", "mode": 420, "contents": {"source": "data:,b"}}]},
+  "systemd": {"units": [{"name": "var-mnt-storage.mount", "enabled": true}]}}`)},
+	}
+	if err := validateIgnition(mergedDoc(t, parts), parts); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateIgnitionReportsEveryProblem(t *testing.T) {
+	parts := []ignPart{
+		{name: "tailpod.bu", ign: []byte(`{"ignition": {"version": "3.5.0"},
+  "storage": {"directories": [{"path": "/etc/quadsync"}]},
+  "systemd": {"units": [{"name": "quadsync-sync.timer", "enabled": true}]},
+  "passwd": {"users": [{"name": "core"}]}}`)},
+		{name: "tailscale.bu", ign: []byte(`{"ignition": {"version": "3.4.0"},
+  "storage": {
+    "directories": [{"path": "/etc/quadsync"}, {"path": "relative/dir"}],
+    "files": [{"path": "/etc/x/../y", "mode": 8192}],
+    "links": [{"path": "/etc/samba", "target": "/tmp"}]
+  },
+  "systemd": {"units": [
+    {"name": "tailscale", "dropins": [{"name": "override"}]},
+    {"name": "debug.service", "mask": true, "enabled": true}
+  ]},
+  "passwd": {"users": [{"name": "Bad User"}]}}`)},
+		{name: "server.bu", ign: []byte(`{"ignition": {"version": "3.5.0"},
+  "storage": {"directories": [{"path": "/etc/samba"}]}}`)},
+	}
+
+	err := validateIgnition(mergedDoc(t, parts), parts)
+	var verr validationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected validationError, got %v", err)
+	}
+	msg := err.Error()
+	for _, want := range []string{
+		`tailscale.bu: ignition.version "3.4.0" differs from merged version "3.5.0"`,
+		"tailscale.bu: storage.directories relative/dir: path is not absolute",
+		"tailscale.bu: storage.files /etc/x/../y: path is not clean (want /etc/y)",
+		"tailscale.bu: storage.files /etc/x/../y: mode 8192 is outside 0000-7777 (octal)",
+		"server.bu, tailscale.bu: storage.links /etc/samba: also declared in storage.directories",
+		"tailscale.bu: systemd.units tailscale: not a valid unit name",
+		`tailscale.bu: systemd.units tailscale: drop-in "override" must be a .conf file name`,
+		"tailscale.bu: systemd.units debug.service: both masked and enabled",
+		`tailscale.bu: passwd.users "Bad User": invalid name`,
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("error missing %q:\n%s", want, msg)
+		}
+	}
+	if len(verr) != 9 {
+		t.Errorf("got %d problems, want 9:\n%s", len(verr), msg)
+	}
+}
+
+func TestValidateIgnitionUnsupportedVersion(t *testing.T) {
+	parts := []ignPart{{name: "tailpod.bu", ign: []byte(`{"ignition": {"version": "2.2.0"}}`)}}
+	err := validateIgnition(mergedDoc(t, parts), parts)
+	if err == nil || !strings.Contains(err.Error(), `unsupported ignition.version "2.2.0"`) {
+		t.Errorf("expected unsupported version error, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// varType is the declared type of a site.env variable. parseEnv checks each
+// value against its variable's type, and render expands list variables.
+type varType string
+
+const (
+	typeString varType = "string"
+	typeBool   varType = "bool" // true or false; "# @if VAR" is kept only for true
+	typeInt    varType = "int"  // a decimal integer
+	typeList   varType = "list" // comma-separated items (see splitList)
+)
+
+// baseVarTypes are the base variables that aren't strings.
+var baseVarTypes = map[string]varType{
+	"SSH_PUBKEYS":  typeList,
+	"TAILPOD_ARCH": typeList,
+	"OVERLAYS":     typeList,
+}
+
+// parseVarType parses a type name from an overlay header.
+func parseVarType(s string) (varType, error) {
+	switch t := varType(s); t {
+	case typeString, typeBool, typeInt, typeList:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown type %q (want string, bool, int or list)", s)
+}
+
+// check reports whether value is valid for t. Values aren't quoted in the
+// error, since a string or list may be a secret.
+func (t varType) check(value string) error {
+	switch t {
+	case typeBool:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%q is not a bool (want true or false)", value)
+		}
+	case typeInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+	}
+	return nil
+}
+
+// isSet reports whether value counts as set for "# @if": non-empty, and
+// true for a bool.
+func (t varType) isSet(value string) bool {
+	if t == typeBool {
+		return value == "true"
+	}
+	return value != ""
+}
+
+// typeOf returns the type of a variable in allowed, defaulting to string.
+func typeOf(allowed map[string]varType, name string) varType {
+	if t := allowed[name]; t != "" {
+		return t
+	}
+	return typeString
+}
+
+// declareVar adds name to allowed with type t, failing if it was already
+// declared with a different type. by names the declaring file.
+func declareVar(allowed map[string]varType, declaredBy map[string]string, name string, t varType, by string) error {
+	if prev, ok := allowed[name]; ok && prev != t {
+		return fmt.Errorf("%s declares %s as %s, but %s declares it as %s", by, name, t, declaredBy[name], prev)
+	}
+	if _, ok := allowed[name]; !ok {
+		declaredBy[name] = by
+	}
+	allowed[name] = t
+	return nil
+}
+
+// flowSequence renders items as a YAML flow sequence of double-quoted
+// scalars. $ is written as \u0024 so that no item reads as a ${VAR}.
+func flowSequence(items []string) (string, error) {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		q, err := applyFilter("yaml", item)
+		if err != nil {
+			return "", err
+		}
+		quoted[i] = strings.ReplaceAll(q, "$", `\u0024`)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]", nil
+}
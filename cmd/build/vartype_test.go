@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVarTypeCheck(t *testing.T) {
+	tests := []struct {
+		typ   varType
+		value string
+		ok    bool
+	}{
+		{typeString, "anything, at all", true},
+		{typeBool, "true", true},
+		{typeBool, "false", true},
+		{typeBool, "yes", false},
+		{typeInt, "445", true},
+		{typeInt, "-1", true},
+		{typeInt, "4a", false},
+		{typeList, "a, b,,c", true},
+		{typeList, "", true},
+	}
+	for _, tt := range tests {
+		if err := tt.typ.check(tt.value); (err == nil) != tt.ok {
+			t.Errorf("%s.check(%q) = %v, want ok=%v", tt.typ, tt.value, err, tt.ok)
+		}
+	}
+	if _, err := parseVarType("float"); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+}
+
+func TestAllowedVarsTypes(t *testing.T) {
+	a := overlay{path: "overlays/a.bu", optional: []string{"PORT"}, types: map[string]varType{"PORT": typeInt}}
+	b := overlay{path: "overlays/b.bu", required: []string{"PORT"}}
+	allowed, err := allowedVars([]overlay{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed["PORT"] != typeInt || allowed["SSH_PUBKEYS"] != typeList || allowed["SSH_PUBKEY"] != typeString {
+		t.Errorf("unexpected types: %v", allowed)
+	}
+
+	_, err = allowedVars([]overlay{a, b})
+	if err == nil || !strings.Contains(err.Error(), "overlays/b.bu declares PORT as string, but overlays/a.bu declares it as int") {
+		t.Errorf("expected a type conflict, got %v", err)
+	}
+	_, err = allowedVars([]overlay{{path: "overlays/c.bu", optional: []string{"OVERLAYS"}}})
+	if err == nil || !strings.Contains(err.Error(), "but tailpod.bu declares it as list") {
+		t.Errorf("expected a conflict with a base variable, got %v", err)
+	}
+}
+
+func TestParseEnvTypes(t *testing.T) {
+	allowed := map[string]varType{"STORAGE_SMB_PORT": typeInt, "METRICS_ENABLED": typeBool}
+	if _, err := parseEnv("STORAGE_SMB_PORT=445\nMETRICS_ENABLED=true\n", allowed); err != nil {
+		t.Fatal(err)
+	}
+	_, err := parseEnv("# comment\nSTORAGE_SMB_PORT=smb\n", allowed)
+	if err == nil || !strings.Contains(err.Error(), `site.env line 2: STORAGE_SMB_PORT: "smb" is not an integer`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, err = parseEnv("METRICS_ENABLED=yes\n", allowed)
+	if err == nil || !strings.Contains(err.Error(), "want true or false") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}